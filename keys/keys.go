@@ -6,14 +6,18 @@ package keys
  * Makes dealing with keys a bit nicer
  * By J. Stuart McMurray
  * Created 20181208
- * Last Modified 20181208
+ * Last Modified 20261017
  */
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"io"
 
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -53,6 +57,55 @@ func GenerateKeypair() (publicKey, privateKey *[32]byte, err error) {
 	return box.GenerateKey(rand.Reader)
 }
 
+// MinSeedLen is the minimum length of a seed passed to FromSeed.
+const MinSeedLen = 32
+
+// ErrShortSeed is returned by FromSeed when the seed is shorter than
+// MinSeedLen bytes.
+var ErrShortSeed = errors.New("seed too short")
+
+/* seedInfo is the HKDF context string used by FromSeed.  Changing it changes
+every key derived from a seed. */
+const seedInfo = "dnsconn keys.FromSeed curve25519 v1"
+
+// FromSeed deterministically derives a keypair from seed, which must be kept
+// secret.  The same seed always yields the same keypair, which allows for
+// long-term identities without storing the private key itself.  The seed must
+// be at least MinSeedLen bytes of uniformly random data, such as from
+// crypto/rand; a password or other guessable seed yields a guessable private
+// key.  The private key is derived from the seed with HKDF-SHA256 using a
+// context string specific to dnsconn, so the same seed used elsewhere doesn't
+// give the same key.
+func FromSeed(seed []byte) (publicKey, privateKey *[32]byte, err error) {
+	if MinSeedLen > len(seed) {
+		return nil, nil, ErrShortSeed
+	}
+	var priv [32]byte
+	if _, err := io.ReadFull(
+		hkdf.New(sha256.New, seed, nil, []byte(seedInfo)),
+		priv[:],
+	); nil != err {
+		return nil, nil, err
+	}
+	pub, err := Public(&priv)
+	if nil != err {
+		return nil, nil, err
+	}
+	return pub, &priv, nil
+}
+
+// Public returns the public key corresponding to the private key.  This is
+// useful for recovering the public half of a persisted private key.
+func Public(privateKey *[32]byte) (*[32]byte, error) {
+	var pub [32]byte
+	b, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if nil != err {
+		return nil, err
+	}
+	copy(pub[:], b)
+	return &pub, nil
+}
+
 // Encode returns the base64 representation of a key.  It is the inverse of
 // Decode.
 func Encode(k *[32]byte) string {
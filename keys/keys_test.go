@@ -5,10 +5,14 @@ package keys
  * Make sure keys works
  * By J. Stuart McMurray
  * Created 20181208
- * Last Modified 20181208
+ * Last Modified 20261017
  */
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
 
 // NRandPair is the number of random keypairs to create
 const NRandPair = 100
@@ -45,3 +49,104 @@ func TestKeys(t *testing.T) {
 		}
 	}
 }
+
+func TestFromSeed(t *testing.T) {
+	seen := make(map[[32]byte]bool)
+	for i := 0; i < NRandPair; i++ {
+		seed := []byte(fmt.Sprintf("seed-%0*v", MinSeedLen-5, i))
+
+		/* The same seed should always give the same keys */
+		ku, kr, err := FromSeed(seed)
+		if nil != err {
+			t.Fatalf("Error deriving keys from %q: %v", seed, err)
+		}
+		ku2, kr2, err := FromSeed(seed)
+		if nil != err {
+			t.Fatalf("Error re-deriving keys from %q: %v", seed, err)
+		}
+		if *ku != *ku2 || *kr != *kr2 {
+			t.Fatalf("Seed %q gave different keys", seed)
+		}
+
+		/* The public key should go with the private key */
+		pub, err := Public(kr)
+		if nil != err {
+			t.Fatalf("Error getting public key: %v", err)
+		}
+		if *ku != *pub {
+			t.Fatalf(
+				"Seed %q gave mismatched keys, Public:%02x "+
+					"From private:%02x",
+				seed,
+				*ku,
+				*pub,
+			)
+		}
+
+		/* Different seeds should give different keys */
+		if seen[*ku] {
+			t.Fatalf("Seed %q gave a duplicate key %02x", seed, *ku)
+		}
+		seen[*ku] = true
+	}
+}
+
+func TestFromSeedKnown(t *testing.T) {
+	/* Seed is 0x00, 0x01, ... 0x1f */
+	seed := make([]byte, MinSeedLen)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	var (
+		wantPub  = "buBp8BCoGhJsMzxOxJKwH9ndJvUe9DyZkWzUnPgkBVQ"
+		wantPriv = "ttq5bp88YcMWPIq_Vben5IJeOvS6WXVrBeWR99hOWew"
+	)
+	ku, kr, err := FromSeed(seed)
+	if nil != err {
+		t.Fatalf("Error deriving keys: %v", err)
+	}
+	if got := Encode(ku); wantPub != got {
+		t.Errorf("Public key %v, want %v", got, wantPub)
+	}
+	if got := Encode(kr); wantPriv != got {
+		t.Errorf("Private key %v, want %v", got, wantPriv)
+	}
+}
+
+func TestFromSeedShort(t *testing.T) {
+	for _, n := range []int{0, 1, MinSeedLen - 1} {
+		if _, _, err := FromSeed(make([]byte, n)); !errors.Is(
+			err,
+			ErrShortSeed,
+		) {
+			t.Errorf(
+				"Expected %v with %v-byte seed, got %v",
+				ErrShortSeed,
+				n,
+				err,
+			)
+		}
+	}
+}
+
+func TestPublic(t *testing.T) {
+	for i := 0; i < NRandPair; i++ {
+		ku, kr, err := GenerateKeypair()
+		if nil != err {
+			t.Fatalf("Error generating keys: %v", err)
+		}
+		pub, err := Public(kr)
+		if nil != err {
+			t.Fatalf("Error getting public key: %v", err)
+		}
+		if *ku != *pub {
+			t.Fatalf(
+				"Public key mismatch, Private:%02x "+
+					"Generated:%02x Public:%02x",
+				*kr,
+				*ku,
+				*pub,
+			)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package resolver
+
+/*
+ * breaker.go
+ * Stop querying when queries keep failing
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of querying when too many queries have
+// failed recently.  See the CircuitBreaker method of Resolver.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreaker configures when queries stop being sent.
+func (r *resolver) CircuitBreaker(
+	rate float64,
+	window int,
+	cooldown time.Duration,
+	notify func(open bool, err error),
+) {
+	r.cbL.Lock()
+	defer r.cbL.Unlock()
+	r.cbRate = rate
+	r.cbWindow = nil
+	if 0 < window && 0 < rate {
+		r.cbWindow = make([]bool, window)
+	}
+	r.cbCool = cooldown
+	r.cbNotify = notify
+	r.cbOpen = false
+	r.cbProbing = false
+	r.breakerReset()
+}
+
+/* breakerAllow returns ErrCircuitOpen if queries shouldn't be sent because
+the circuit breaker is open and cooling down or another query is already
+probing whether the server's back.  If the returned bool is true, the query is
+that probe.  Either way, if breakerAllow doesn't return an error, breakerNote
+must be called with the query's result. */
+func (r *resolver) breakerAllow() (bool, error) {
+	r.cbL.Lock()
+	defer r.cbL.Unlock()
+	if 0 == len(r.cbWindow) || !r.cbOpen {
+		return false, nil
+	}
+	if r.cbProbing || r.clock.now().Before(r.cbUntil) {
+		return false, ErrCircuitOpen
+	}
+	r.cbProbing = true
+	return true, nil
+}
+
+/* breakerNote notes the result of a query, opening or closing the circuit
+breaker as appropriate.  The value of probe should be the one returned from
+breakerAllow. */
+func (r *resolver) breakerNote(err error, probe bool) {
+	r.cbL.Lock()
+
+	/* Don't bother if we're not using the breaker */
+	if 0 == len(r.cbWindow) {
+		r.cbL.Unlock()
+		return
+	}
+	if probe {
+		r.cbProbing = false
+	}
+
+	/* Nonexistent names aren't a problem with the path to the server */
+	if errors.Is(err, ErrRCNXDomain) {
+		err = nil
+	}
+
+	/* Work out whether we've changed state.  Failures of queries sent
+	before the breaker opened don't start another cool-down, but a
+	success from anything closes it. */
+	var changed bool
+	switch {
+	case nil == err && r.cbOpen: /* Back to normal */
+		changed = true
+		r.cbOpen = false
+		r.cbProbing = false
+		r.breakerReset()
+	case nil == err:
+		r.breakerRecord(false)
+	case probe: /* Still broken */
+		r.cbUntil = r.clock.now().Add(r.breakerCooldown())
+	case r.cbOpen: /* Sent before the breaker opened */
+	case r.breakerRecord(true): /* Too many failures */
+		changed = true
+		r.cbOpen = true
+		r.cbUntil = r.clock.now().Add(r.breakerCooldown())
+	}
+	notify := r.cbNotify
+	open := r.cbOpen
+	r.cbL.Unlock()
+
+	/* Let someone know if we changed state */
+	if changed && nil != notify {
+		notify(open, err)
+	}
+}
+
+/* breakerRecord records whether a query failed in the window of recent
+queries.  It returns true if the window is full and the failure rate is at
+least r.cbRate.  r.cbL must be held. */
+func (r *resolver) breakerRecord(failed bool) bool {
+	/* Replace the oldest result */
+	if r.cbWindow[r.cbNext] {
+		r.cbFails--
+	}
+	r.cbWindow[r.cbNext] = failed
+	if failed {
+		r.cbFails++
+	}
+	r.cbNext = (r.cbNext + 1) % len(r.cbWindow)
+	if len(r.cbWindow) > r.cbSeen {
+		r.cbSeen++
+	}
+
+	return len(r.cbWindow) == r.cbSeen &&
+		float64(r.cbFails) >= r.cbRate*float64(len(r.cbWindow))
+}
+
+/* breakerReset empties the window of recent queries.  r.cbL must be held. */
+func (r *resolver) breakerReset() {
+	for i := range r.cbWindow {
+		r.cbWindow[i] = false
+	}
+	r.cbNext = 0
+	r.cbSeen = 0
+	r.cbFails = 0
+}
+
+/* breakerCooldown returns a cool-down time between r.cbCool and one and a
+half times r.cbCool.  r.cbL must be held. */
+func (r *resolver) breakerCooldown() time.Duration {
+	u, err := r.randUint16()
+	if nil != err {
+		return r.cbCool
+	}
+	return r.cbCool + time.Duration(
+		float64(r.cbCool/2)*float64(u)/float64(0xFFFF),
+	)
+}
@@ -0,0 +1,175 @@
+package resolver
+
+/*
+ * breaker_test.go
+ * Make sure the circuit breaker opens and closes
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	r, fc, qch, sc := newTestResolver(t)
+
+	/* Note state changes */
+	var events []bool
+	r.CircuitBreaker(0.75, 4, time.Minute, func(open bool, err error) {
+		if open && !errors.Is(err, ErrRCServFail) {
+			t.Errorf("Breaker opened with unexpected error %v", err)
+		}
+		events = append(events, open)
+	})
+
+	/* Answer each query with the next rcode */
+	rcch := make(chan dnsmessage.RCode, 1)
+	go func() {
+		for qm := range qch {
+			if !reply(t, sc, qm, <-rcch, nil, nil, 0) {
+				return
+			}
+		}
+	}()
+
+	/* lookup does a lookup, answering with SERVFAIL if want is
+	ErrRCServFail or success if want is nil, and checks the error */
+	lookup := func(want error) {
+		t.Helper()
+		switch want {
+		case nil:
+			rcch <- dnsmessage.RCodeSuccess
+		case ErrRCServFail:
+			rcch <- dnsmessage.RCodeServerFailure
+		}
+		_, err := r.LookupA("example.com")
+		if nil == want && nil == err {
+			return
+		}
+		if !errors.Is(err, want) {
+			t.Fatalf("Expected error %v, got %v", want, err)
+		}
+	}
+
+	/* Failures are counted over the last four queries, so the rate
+	doesn't get to three in four until the seventh query */
+	for _, want := range []error{
+		ErrRCServFail,
+		ErrRCServFail,
+		nil,
+		nil,
+		ErrRCServFail,
+		ErrRCServFail,
+	} {
+		lookup(want)
+	}
+	if 0 != len(events) {
+		t.Fatalf("Breaker changed state early: %v", events)
+	}
+	lookup(ErrRCServFail)
+	lookup(ErrCircuitOpen)
+	if 1 != len(events) || !events[0] {
+		t.Fatalf("Expected one open event, got %v", events)
+	}
+
+	/* Not quite long enough */
+	fc.advance(time.Minute - time.Second)
+	lookup(ErrCircuitOpen)
+
+	/* After the cool-down, a failure should reopen it quietly */
+	fc.advance(time.Minute)
+	lookup(ErrRCServFail)
+	lookup(ErrCircuitOpen)
+	if 1 != len(events) {
+		t.Fatalf("Unexpected events %v", events)
+	}
+
+	/* And a success should close it */
+	fc.advance(2 * time.Minute)
+	lookup(nil)
+	if 2 != len(events) || events[1] {
+		t.Fatalf("Expected a close event, got %v", events)
+	}
+
+	/* With an empty window, it takes four queries to reopen it */
+	for i := 0; i < 3; i++ {
+		lookup(ErrRCServFail)
+	}
+	if 2 != len(events) {
+		t.Fatalf("Breaker reopened early: %v", events)
+	}
+	lookup(ErrRCServFail)
+	lookup(ErrCircuitOpen)
+	if 3 != len(events) || !events[2] {
+		t.Fatalf("Expected another open event, got %v", events)
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	r, fc, qch, sc := newTestResolver(t)
+	r.CircuitBreaker(1, 1, time.Minute, nil)
+
+	/* lookup starts a lookup and returns the query it sends */
+	lookup := func() (*dnsmessage.Message, <-chan aResult) {
+		t.Helper()
+		res := goLookupA(r, "example.com")
+		return <-qch, res
+	}
+	/* answer answers qm with rc and makes sure we get the right error */
+	answer := func(
+		qm *dnsmessage.Message,
+		res <-chan aResult,
+		rc dnsmessage.RCode,
+		want error,
+	) {
+		t.Helper()
+		if !reply(t, sc, qm, rc, nil, nil, 0) {
+			t.FailNow()
+		}
+		got := <-res
+		if nil == want && nil == got.err {
+			return
+		}
+		if !errors.Is(got.err, want) {
+			t.Fatalf("Expected error %v, got %v", want, got.err)
+		}
+	}
+	/* open makes sure the breaker's open */
+	open := func() {
+		t.Helper()
+		if _, err := r.LookupA("example.com"); !errors.Is(
+			err,
+			ErrCircuitOpen,
+		) {
+			t.Fatalf("Expected %v, got %v", ErrCircuitOpen, err)
+		}
+	}
+
+	/* One failure opens the breaker */
+	qm, res := lookup()
+	answer(qm, res, dnsmessage.RCodeServerFailure, ErrRCServFail)
+	open()
+
+	/* A failed probe starts another cool-down */
+	fc.advance(2 * time.Minute)
+	qm, res = lookup()
+	answer(qm, res, dnsmessage.RCodeServerFailure, ErrRCServFail)
+	open()
+
+	/* While a probe is in flight, nothing else gets through */
+	fc.advance(2 * time.Minute)
+	qm, res = lookup()
+	open()
+	open()
+
+	/* And when it succeeds, the breaker closes */
+	answer(qm, res, dnsmessage.RCodeSuccess, nil)
+	qm, res = lookup()
+	answer(qm, res, dnsmessage.RCodeSuccess, nil)
+}
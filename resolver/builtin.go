@@ -5,17 +5,20 @@ package resolver
  * Wraps the net.Lookup* functions
  * By J. Stuart McMurray
  * Created 20180925
- * Last Modified 20181013
+ * Last Modified 20261017
  */
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
+	"net/http"
+	"syscall"
 	"time"
 )
 
-// ErrNotImplemented is returned by StdlibResolver's LookupAC and LookupAAAAAC
-// methods.  This should not be confused with ErrRCNotImp.
+// ErrNotImplemented is returned by StdlibResolver's LookupAC, LookupAAAAAC,
+// and ClientSubnet methods.  This should not be confused with ErrRCNotImp.
 var ErrNotImplemented = errors.New("not implemented")
 
 /* stdlib exists only to define methods on */
@@ -49,6 +52,12 @@ func (s stdlib) lookupIPFilter(
 	name string,
 	check func(i net.IP) net.IP,
 ) ([]net.IP, error) {
+	/* Make sure the name is ASCII */
+	name, err := toASCII(name)
+	if nil != err {
+		return nil, err
+	}
+
 	/* Lookup the addresses */
 	as, err := net.LookupIP(name)
 	if nil != err {
@@ -76,6 +85,12 @@ func (s stdlib) LookupAC(string) ([]string, error) {
 
 // LookupNS wraps net.LookupNS.
 func (s stdlib) LookupNS(name string) ([]string, error) {
+	/* Make sure the name is ASCII */
+	name, err := toASCII(name)
+	if nil != err {
+		return nil, err
+	}
+
 	/* Wrap call */
 	ns, err := net.LookupNS(name)
 	if nil != err {
@@ -93,6 +108,12 @@ func (s stdlib) LookupNS(name string) ([]string, error) {
 
 // LookupCNAME wraps net.LookupCNAME
 func (s stdlib) LookupCNAME(name string) ([]string, error) {
+	/* Make sure the name is ASCII */
+	name, err := toASCII(name)
+	if nil != err {
+		return nil, err
+	}
+
 	n, err := net.LookupCNAME(name)
 	return []string{n}, err
 }
@@ -104,6 +125,12 @@ func (s stdlib) LookupPTR(ip net.IP) ([]string, error) {
 
 // LookupMX wraps net.LookupMX
 func (s stdlib) LookupMX(name string) ([]MX, error) {
+	/* Make sure the name is ASCII */
+	name, err := toASCII(name)
+	if nil != err {
+		return nil, err
+	}
+
 	/* Wrap call */
 	mxs, err := net.LookupMX(name)
 	if nil != err {
@@ -122,6 +149,12 @@ func (s stdlib) LookupMX(name string) ([]MX, error) {
 
 // LookupTXT wraps net.LookupTXT
 func (s stdlib) LookupTXT(name string) ([]string, error) {
+	/* Make sure the name is ASCII */
+	name, err := toASCII(name)
+	if nil != err {
+		return nil, err
+	}
+
 	return net.LookupTXT(name)
 }
 
@@ -158,6 +191,12 @@ func (s stdlib) LookupAAAAC(string) ([]string, error) {
 
 // LookupSRV wraps net.LookupSRV
 func (s stdlib) LookupSRV(name string) ([]SRV, error) {
+	/* Make sure the name is ASCII */
+	name, err := toASCII(name)
+	if nil != err {
+		return nil, err
+	}
+
 	/* Wrap call */
 	_, srvs, err := net.LookupSRV("", "", name)
 	if nil != err {
@@ -181,3 +220,45 @@ func (s stdlib) Timeout(time.Duration) {}
 
 // RetryInterval is a no-op.
 func (s stdlib) RetryInterval(time.Duration) {}
+
+// LocalAddr is a no-op.
+func (s stdlib) LocalAddr(net.IP) {}
+
+// DialControl is a no-op.
+func (s stdlib) DialControl(
+	func(network, address string, c syscall.RawConn) error,
+) {
+}
+
+// UnicodeNames is a no-op.
+func (s stdlib) UnicodeNames(bool) {}
+
+// FollowCNAMEs is a no-op.  CNAMEs are always followed.
+func (s stdlib) FollowCNAMEs(int) {}
+
+// CacheNXDomain is a no-op.
+func (s stdlib) CacheNXDomain(time.Duration) {}
+
+// ClientSubnet always returns ErrNotImplemented.
+func (s stdlib) ClientSubnet(*net.IPNet) error { return ErrNotImplemented }
+
+// TCPFallback is a no-op.
+func (s stdlib) TCPFallback(int) {}
+
+// UDPSockets is a no-op.
+func (s stdlib) UDPSockets(int) {}
+
+// CircuitBreaker is a no-op.
+func (s stdlib) CircuitBreaker(
+	float64,
+	int,
+	time.Duration,
+	func(bool, error),
+) {
+}
+
+// HTTPClient is a no-op.
+func (s stdlib) HTTPClient(*http.Client) {}
+
+// TLSConfig is a no-op.
+func (s stdlib) TLSConfig(*tls.Config) {}
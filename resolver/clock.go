@@ -0,0 +1,28 @@
+package resolver
+
+/*
+ * clock.go
+ * Source of time, replaceable for testing
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261016
+ */
+
+import "time"
+
+/* clock is the source of time used for timeouts, retries, and cache expiry,
+so tests can use virtual time instead of sleeping. */
+type clock interface {
+	/* now returns the current time */
+	now() time.Time
+
+	/* after waits for d to elapse and then sends the current time on the
+	returned channel, like time.After. */
+	after(d time.Duration) <-chan time.Time
+}
+
+/* realClock is a clock which uses the time package */
+type realClock struct{}
+
+func (realClock) now() time.Time                         { return time.Now() }
+func (realClock) after(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -5,7 +5,7 @@ package resolver
  * Connection to a DNS server
  * By J. Stuart McMurray
  * Created 20181009
- * Last Modified 20181013
+ * Last Modified 20261017
  */
 
 import (
@@ -14,7 +14,6 @@ import (
 	"io"
 	"net"
 	"sync"
-	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
@@ -27,7 +26,8 @@ type ansOrErr struct {
 
 /* conn represents a connection to a DNS server. */
 type conn struct {
-	r *resolver /* Parent resolver */
+	r      *resolver /* Parent resolver */
+	server string    /* Server name, for errors */
 
 	isPC bool /* c.(net.PacketConn)? */
 	c    net.Conn
@@ -80,14 +80,16 @@ func (c *conn) newAnsChannel() (
 	nch := make(chan ansOrErr)
 	c.ansCh[id] = nch
 
-	/* Close the channel if the message takes too long to come back */
+	/* Close the channel if the message takes too long to come back.  The
+	timer starts now, before the query's sent, and not whenever the
+	goroutine gets around to it. */
+	c.r.qtoL.RLock()
+	to := c.r.qto
+	c.r.qtoL.RUnlock()
+	tch := c.r.clock.after(to)
 	go func() {
-		/* Work out how long to sleep before killing the channel */
-		c.r.qtoL.RLock()
-		to := c.r.qto
-		c.r.qtoL.RUnlock()
 		/* Wait until the timeout */
-		time.Sleep(to)
+		<-tch
 		/* Grab hold of the channel if we have one */
 		c.ansChL.Lock()
 		defer c.ansChL.Unlock()
@@ -163,8 +165,10 @@ func (c *conn) listenForAnswers() {
 			return
 		}
 
-		/* Send it to the right place */
-		go c.sendAnsChannel(msg)
+		/* Send it to the right place.  This doesn't block, and
+		doing it before the next read keeps the answer from losing a
+		race with an error from the next read. */
+		c.sendAnsChannel(msg)
 	}
 }
 
@@ -191,14 +195,13 @@ func (c *conn) sendAnsChannel(a *dnsmessage.Message) {
 	}()
 }
 
-/* query makes a query via c */
-func (c *conn) query(qm *dnsmessage.Message) (
-	[]dnsmessage.Resource,
-	dnsmessage.RCode,
-	error,
-) {
+/* query makes a query via c and returns the reply */
+func (c *conn) query(qm *dnsmessage.Message) (*dnsmessage.Message, error) {
 	/* Get the query ID as well as the channel from which to read it */
 	id, ch, err := c.newAnsChannel()
+	if nil != err {
+		return nil, err
+	}
 
 	/* Add the ID and roll the message */
 	qm.Header.ID = id
@@ -206,7 +209,7 @@ func (c *conn) query(qm *dnsmessage.Message) (
 	defer c.r.bufpool.Put(qbuf)
 	m, err := qm.AppendPack(qbuf[:0])
 	if nil != err {
-		return nil, 0xFFFF, err
+		return nil, err
 	}
 
 	/* If we're not sending on a packetconn, add the size */
@@ -214,7 +217,7 @@ func (c *conn) query(qm *dnsmessage.Message) (
 		sm := c.r.bufpool.Get().([]byte)
 		defer c.r.bufpool.Put(sm)
 		if len(sm)-2 < len(m) {
-			return nil, 0, errors.New("message too large")
+			return nil, errors.New("message too large")
 		}
 		binary.BigEndian.PutUint16(sm, uint16(len(m)))
 		copy(sm[2:], m)
@@ -224,7 +227,7 @@ func (c *conn) query(qm *dnsmessage.Message) (
 
 	/* Send the message */
 	if err := c.send(m); nil != err {
-		return nil, 0xFFFF, err
+		return nil, err
 	}
 
 	/* If we've a packetconn, keep sending the request until we've a reply
@@ -236,7 +239,7 @@ func (c *conn) query(qm *dnsmessage.Message) (
 	if c.isPC {
 		wg.Add(1)
 		go func() {
-			wg.Done()
+			defer wg.Done()
 
 			/* Retry interval */
 			c.r.qtoL.Lock()
@@ -245,8 +248,8 @@ func (c *conn) query(qm *dnsmessage.Message) (
 			for {
 				select {
 				case <-done:
-					break
-				case <-time.After(rint):
+					return
+				case <-c.r.clock.after(rint):
 					err = c.send(m)
 				}
 			}
@@ -260,16 +263,16 @@ func (c *conn) query(qm *dnsmessage.Message) (
 
 	/* If we got an error back, that's that */
 	if nil != ans.err {
-		return nil, 0xFFFF, ans.err
+		return nil, ans.err
 	}
 
 	/* If we didn't get a better error, but the answer channel was closed,
 	it's a timeout */
 	if !ok && nil == err {
-		return nil, 0xFFFF, ErrAnswerTimeout
+		return nil, ErrAnswerTimeout
 	}
 
-	return ans.answer.Answers, ans.answer.Header.RCode, err
+	return ans.answer, err
 }
 
 /* stop sends an error message to every channel and closes the conn.  This
@@ -0,0 +1,572 @@
+package resolver
+
+/*
+ * conn_test.go
+ * Make sure timeouts and retries work, in virtual time
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261017
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* fakeClock is a clock which only moves when advanced */
+type fakeClock struct {
+	t       time.Time
+	waiters []fakeWaiter
+	l       sync.Mutex
+	c       *sync.Cond /* Broadcast when a waiter is added */
+}
+
+/* fakeWaiter is a channel waiting for a time */
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	fc := &fakeClock{t: time.Unix(0, 0)}
+	fc.c = sync.NewCond(&fc.l)
+	return fc
+}
+
+func (fc *fakeClock) now() time.Time {
+	fc.l.Lock()
+	defer fc.l.Unlock()
+	return fc.t
+}
+
+func (fc *fakeClock) after(d time.Duration) <-chan time.Time {
+	fc.l.Lock()
+	defer fc.l.Unlock()
+	ch := make(chan time.Time, 1)
+	fc.waiters = append(fc.waiters, fakeWaiter{at: fc.t.Add(d), ch: ch})
+	fc.c.Broadcast()
+	return ch
+}
+
+/* waitFor waits until at least n calls to after are waiting */
+func (fc *fakeClock) waitFor(n int) {
+	fc.l.Lock()
+	defer fc.l.Unlock()
+	for len(fc.waiters) < n {
+		fc.c.Wait()
+	}
+}
+
+/* advance moves the clock forward by d and wakes up waiters whose time has
+come. */
+func (fc *fakeClock) advance(d time.Duration) {
+	fc.l.Lock()
+	defer fc.l.Unlock()
+	fc.t = fc.t.Add(d)
+	last := 0
+	for _, w := range fc.waiters {
+		if fc.t.Before(w.at) {
+			fc.waiters[last] = w
+			last++
+			continue
+		}
+		w.ch <- fc.t
+	}
+	fc.waiters = fc.waiters[:last]
+}
+
+/* pktConn makes a net.Conn look like a net.PacketConn, so the resolver will
+retry queries sent on it. */
+type pktConn struct{ net.Conn }
+
+func (p pktConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := p.Read(b)
+	return n, p.RemoteAddr(), err
+}
+
+func (p pktConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return p.Write(b)
+}
+
+/* newTestResolver returns a resolver with a fake clock which sends queries
+on a datagram-ish conn.  Queries sent by the resolver are sent to the returned
+channel.  Replies written to the returned net.Conn are read by the
+resolver. */
+func newTestResolver(t *testing.T) (
+	*resolver,
+	*fakeClock,
+	<-chan *dnsmessage.Message,
+	net.Conn,
+) {
+	rc, sc := net.Pipe()
+	t.Cleanup(func() { rc.Close(); sc.Close() })
+
+	/* Read queries */
+	qch := make(chan *dnsmessage.Message)
+	go func() {
+		defer close(qch)
+		for {
+			qm := readQuery(t, sc, false)
+			if nil == qm {
+				return
+			}
+			qch <- qm
+		}
+	}()
+
+	fc := newFakeClock()
+	r := NewResolverFromConn(pktConn{rc}).(*resolver)
+	r.clock = fc
+
+	return r, fc, qch, sc
+}
+
+/* waitForAt waits until a call to after is waiting for the time at. */
+func (fc *fakeClock) waitForAt(at time.Time) {
+	fc.l.Lock()
+	defer fc.l.Unlock()
+	for {
+		for _, w := range fc.waiters {
+			if w.at.Equal(at) {
+				return
+			}
+		}
+		fc.c.Wait()
+	}
+}
+
+/* testQuery is a query received by a server from newDialResolver. */
+type testQuery struct {
+	qm    *dnsmessage.Message
+	c     net.Conn   /* Server's end of the conn */
+	flags replyFlags /* replyStream if the query came in via TCP */
+	sock  int        /* Which dial the conn came from, starting at 0 */
+}
+
+/* stream returns true if q came in over a stream, i.e. TCP. */
+func (q testQuery) stream() bool { return 0 != q.flags&replyStream }
+
+/* newDialResolver returns a resolver with a fake clock and a single server,
+given as a udp:// URL, which "dials" the server with net.Pipe.  Queries sent by
+the resolver are sent to the first returned channel and the number of each
+dialed conn closed by the resolver is sent to the second. */
+func newDialResolver(t *testing.T) (
+	*resolver,
+	*fakeClock,
+	<-chan testQuery,
+	<-chan int,
+) {
+	res, err := NewResolver(RoundRobin, "udp://192.0.2.1")
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+	r := res.(*resolver)
+	fc := newFakeClock()
+	r.clock = fc
+
+	/* Buffered, so resends don't block the resolver */
+	var (
+		qch   = make(chan testQuery, 1024)
+		cch   = make(chan int, 1024)
+		nDial int
+		dialL sync.Mutex
+	)
+	r.dial = func(s serverAddr) (net.Conn, error) {
+		dialL.Lock()
+		sock := nDial
+		nDial++
+		dialL.Unlock()
+
+		rc, sc := net.Pipe()
+		t.Cleanup(func() { rc.Close(); sc.Close() })
+
+		/* Read queries until the resolver hangs up */
+		var flags replyFlags
+		if "tcp" == s.net {
+			flags = replyStream
+		}
+		go func() {
+			defer func() { cch <- sock }()
+			for {
+				qm := readQuery(t, sc, 0 != flags&replyStream)
+				if nil == qm {
+					return
+				}
+				qch <- testQuery{qm, sc, flags, sock}
+			}
+		}()
+
+		if 0 != flags&replyStream {
+			return rc, nil
+		}
+		return pktConn{rc}, nil
+	}
+
+	return r, fc, qch, cch
+}
+
+/* readStream reads a length-prefixed message from r into buf and returns its
+length. */
+func readStream(r io.Reader, buf []byte) (int, error) {
+	var sb [2]byte
+	if _, err := io.ReadFull(r, sb[:]); nil != err {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(sb[:]))
+	if len(buf) < n {
+		return 0, io.ErrShortBuffer
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+/* readQuery reads a query from r, length-prefixed if stream is true, and
+unpacks it.  It is safe to call from goroutines other than the test's.  If
+reading fails, usually because the conn was closed, readQuery returns nil; if
+unpacking fails, the test is also marked as failed. */
+func readQuery(t *testing.T, r io.Reader, stream bool) *dnsmessage.Message {
+	var (
+		buf = make([]byte, buflen)
+		n   int
+		err error
+	)
+	if stream {
+		n, err = readStream(r, buf)
+	} else {
+		n, err = r.Read(buf)
+	}
+	if nil != err {
+		return nil
+	}
+	qm := new(dnsmessage.Message)
+	if err := qm.Unpack(buf[:n]); nil != err {
+		t.Errorf("Unable to unpack query: %v", err)
+		return nil
+	}
+	return qm
+}
+
+/* replyFlags modify the replies sent by reply. */
+type replyFlags uint
+
+const (
+	replyStream replyFlags = 1 << iota /* Length-prefix, for TCP */
+	replyTC                            /* Set the TC bit */
+	replyAA                            /* Set the AA bit */
+)
+
+/* reply sends a reply to qm on w with the given rcode, records, and flags.  It
+is safe to call from goroutines other than the test's; on error, the test is
+marked as failed and reply returns false. */
+func reply(
+	t *testing.T,
+	w io.Writer,
+	qm *dnsmessage.Message,
+	rcode dnsmessage.RCode,
+	anss []dnsmessage.Resource,
+	auths []dnsmessage.Resource,
+	flags replyFlags,
+) bool {
+	am := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            qm.Header.ID,
+			Response:      true,
+			Authoritative: 0 != flags&replyAA,
+			Truncated:     0 != flags&replyTC,
+			RCode:         rcode,
+		},
+		Questions:   qm.Questions,
+		Answers:     anss,
+		Authorities: auths,
+	}
+	b, err := am.AppendPack(make([]byte, 2))
+	if nil != err {
+		t.Errorf("Unable to pack reply: %v", err)
+		return false
+	}
+	if 0 != flags&replyStream {
+		binary.BigEndian.PutUint16(b, uint16(len(b)-2))
+	} else {
+		b = b[2:]
+	}
+	if _, err := w.Write(b); nil != err {
+		t.Errorf("Unable to send reply: %v", err)
+		return false
+	}
+	return true
+}
+
+/* pktWriter writes to addr on pc. */
+type pktWriter struct {
+	pc   net.PacketConn
+	addr net.Addr
+}
+
+func (w pktWriter) Write(b []byte) (int, error) {
+	return w.pc.WriteTo(b, w.addr)
+}
+
+/* newUDPServer starts a UDP server on the loopback address which answers
+queries with the rcode and answers returned by f, which is passed the query
+and its source address.  The server's address is returned as a udp:// URL
+suitable for NewResolver. */
+func newUDPServer(t *testing.T, f func(
+	from net.Addr,
+	qm *dnsmessage.Message,
+) (dnsmessage.RCode, []dnsmessage.Resource)) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, buflen)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if nil != err {
+				return
+			}
+			qm := new(dnsmessage.Message)
+			if err := qm.Unpack(buf[:n]); nil != err {
+				t.Errorf("Unable to unpack query: %v", err)
+				return
+			}
+			rc, anss := f(from, qm)
+			w := pktWriter{pc, from}
+			if !reply(t, w, qm, rc, anss, nil, 0) {
+				return
+			}
+		}
+	}()
+
+	return "udp://" + pc.LocalAddr().String()
+}
+
+/* aResult is the result of an A lookup */
+type aResult struct {
+	as  [][4]byte
+	err error
+}
+
+/* goLookupA looks up name's A records in the background. */
+func goLookupA(r Resolver, name string) <-chan aResult {
+	ch := make(chan aResult, 1)
+	go func() {
+		as, err := r.LookupA(name)
+		ch <- aResult{as, err}
+	}()
+	return ch
+}
+
+func TestQueryRetryTimeout(t *testing.T) {
+	r, fc, qch, _ := newTestResolver(t)
+
+	/* Make a query which will never be answered */
+	ech := make(chan error, 1)
+	go func() {
+		_, err := r.LookupA("example.com")
+		ech <- err
+	}()
+	<-qch
+
+	/* Should get a resend every retry interval until the timeout */
+	var nresend int
+	for elapsed := time.Duration(0); TIMEOUT > elapsed; {
+		fc.waitFor(2) /* Timeout and resend */
+		d := RETRYINTERVAL
+		if TIMEOUT < elapsed+d {
+			d = TIMEOUT - elapsed
+		}
+		fc.advance(d)
+		elapsed += d
+		if TIMEOUT > elapsed {
+			<-qch
+			nresend++
+		}
+	}
+	if want := int(TIMEOUT / RETRYINTERVAL); want != nresend {
+		t.Errorf("Got %v resends, expected %v", nresend, want)
+	}
+
+	/* And then a timeout */
+	if err := <-ech; !errors.Is(err, ErrAnswerTimeout) {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+}
+
+func TestQueryRetryAnswer(t *testing.T) {
+	r, fc, qch, sc := newTestResolver(t)
+
+	/* Make a query */
+	res := goLookupA(r, "example.com")
+	<-qch
+
+	/* Answer the resend */
+	fc.waitFor(2)
+	fc.advance(RETRYINTERVAL)
+	qm := <-qch
+	if !reply(t, sc, qm, dnsmessage.RCodeSuccess, []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  qm.Questions[0].Name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}}, nil, 0) {
+		t.FailNow()
+	}
+
+	got := <-res
+	if nil != got.err {
+		t.Fatalf("Lookup failed: %v", got.err)
+	}
+	if 1 != len(got.as) || [4]byte{192, 0, 2, 1} != got.as[0] {
+		t.Fatalf("Unexpected answer %v", got.as)
+	}
+}
+
+func TestCacheNXDomainExpiry(t *testing.T) {
+	r, fc, qch, sc := newTestResolver(t)
+	r.CacheNXDomain(time.Hour)
+
+	/* Answer every query with an NXDOMAIN with a 30 second MINIMUM */
+	var nq int32
+	go func() {
+		for qm := range qch {
+			atomic.AddInt32(&nq, 1)
+			if !reply(t, sc, qm, dnsmessage.RCodeNameError, nil,
+				[]dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{
+						Name:  dnsmessage.MustNewName("com."),
+						Type:  dnsmessage.TypeSOA,
+						Class: dnsmessage.ClassINET,
+						TTL:   300,
+					},
+					Body: &dnsmessage.SOAResource{
+						NS:     dnsmessage.MustNewName("ns.com."),
+						MBox:   dnsmessage.MustNewName("h.com."),
+						MinTTL: 30,
+					},
+				}}, 0) {
+				return
+			}
+		}
+	}()
+
+	/* lookup makes sure a lookup fails with NXDOMAIN and that the
+	expected number of queries have been sent. */
+	lookup := func(want int32) {
+		t.Helper()
+		if _, err := r.LookupA("nx.example.com"); !errors.Is(
+			err,
+			ErrRCNXDomain,
+		) {
+			t.Fatalf("Expected NXDOMAIN, got %v", err)
+		}
+		if got := atomic.LoadInt32(&nq); want != got {
+			t.Fatalf("Expected %v queries, got %v", want, got)
+		}
+	}
+
+	/* Second lookup should be cached */
+	lookup(1)
+	fc.advance(29 * time.Second)
+	lookup(1)
+
+	/* After the TTL, the name should be queried again */
+	fc.advance(2 * time.Second)
+	lookup(2)
+}
+
+func TestCacheNXDomainAlias(t *testing.T) {
+	r, _, qch, sc := newTestResolver(t)
+	r.CacheNXDomain(time.Hour)
+
+	/* Answer every query with a CNAME to a name which doesn't exist */
+	var nq int32
+	go func() {
+		for qm := range qch {
+			atomic.AddInt32(&nq, 1)
+			if !reply(t, sc, qm, dnsmessage.RCodeNameError,
+				[]dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{
+						Name:  qm.Questions[0].Name,
+						Type:  dnsmessage.TypeCNAME,
+						Class: dnsmessage.ClassINET,
+						TTL:   300,
+					},
+					Body: &dnsmessage.CNAMEResource{
+						CNAME: dnsmessage.MustNewName(
+							"gone.example.com.",
+						),
+					},
+				}},
+				[]dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{
+						Name:  dnsmessage.MustNewName("com."),
+						Type:  dnsmessage.TypeSOA,
+						Class: dnsmessage.ClassINET,
+						TTL:   300,
+					},
+					Body: &dnsmessage.SOAResource{
+						NS:     dnsmessage.MustNewName("ns.com."),
+						MBox:   dnsmessage.MustNewName("h.com."),
+						MinTTL: 30,
+					},
+				}}, 0) {
+				return
+			}
+		}
+	}()
+
+	/* The alias exists, so every lookup should be sent */
+	for want := int32(1); 3 >= want; want++ {
+		if _, err := r.LookupA("alias.example.com"); !errors.Is(
+			err,
+			ErrRCNXDomain,
+		) {
+			t.Fatalf("Expected NXDOMAIN, got %v", err)
+		}
+		if got := atomic.LoadInt32(&nq); want != got {
+			t.Fatalf("Expected %v queries, got %v", want, got)
+		}
+	}
+}
+
+func TestAnswerBeforeHangup(t *testing.T) {
+	/* The race is a bit racy itself, so try quite a few times */
+	for i := 0; i < 1000; i++ {
+		rc, sc := net.Pipe()
+		r := NewResolverFromConn(rc)
+
+		/* Answer one query and immediately hang up */
+		go func() {
+			defer sc.Close()
+			if qm := readQuery(t, sc, true); nil != qm {
+				reply(
+					t,
+					sc,
+					qm,
+					dnsmessage.RCodeSuccess,
+					nil,
+					nil,
+					replyStream,
+				)
+			}
+		}()
+
+		/* The answer should win against the hangup */
+		if _, err := r.LookupA("example.com"); nil != err {
+			t.Fatalf("Lookup %v failed: %v", i, err)
+		}
+		rc.Close()
+	}
+}
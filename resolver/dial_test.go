@@ -0,0 +1,161 @@
+package resolver
+
+/*
+ * dial_test.go
+ * Make sure LocalAddr and DialControl affect dials
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* lookupAFrom looks up an A record with r, which should get want as the
+answer, and makes sure it worked. */
+func lookupAFrom(t *testing.T, r Resolver, want [4]byte) {
+	t.Helper()
+	as, err := r.LookupA("example.com")
+	if nil != err {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if 1 != len(as) || want != as[0] {
+		t.Fatalf("Unexpected answer %v", as)
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	laddr := net.IPv4(127, 0, 0, 2)
+	want := [4]byte{192, 0, 2, 17}
+	anss := []dnsmessage.Resource{aRR("example.com.", want)}
+
+	t.Run("udp", func(t *testing.T) {
+		/* Answer queries, noting where they came from */
+		fch := make(chan net.Addr, 1)
+		server := newUDPServer(t, func(
+			from net.Addr,
+			qm *dnsmessage.Message,
+		) (dnsmessage.RCode, []dnsmessage.Resource) {
+			select {
+			case fch <- from:
+			default: /* Resent query */
+			}
+			return dnsmessage.RCodeSuccess, anss
+		})
+
+		r, err := NewResolver(RoundRobin, server)
+		if nil != err {
+			t.Fatalf("Unable to make resolver: %v", err)
+		}
+		r.LocalAddr(laddr)
+		lookupAFrom(t, r, want)
+		if from := (<-fch).(*net.UDPAddr); !laddr.Equal(from.IP) {
+			t.Errorf("Query came from %v, not %v", from, laddr)
+		}
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if nil != err {
+			t.Fatalf("Unable to listen: %v", err)
+		}
+		defer l.Close()
+
+		/* Answer one query, noting where it came from */
+		fch := make(chan net.Addr, 1)
+		go func() {
+			c, err := l.Accept()
+			if nil != err {
+				t.Errorf("Accept: %v", err)
+				return
+			}
+			defer c.Close()
+			fch <- c.RemoteAddr()
+			qm := readQuery(t, c, true)
+			if nil == qm {
+				t.Errorf("Did not get query")
+				return
+			}
+			reply(
+				t,
+				c,
+				qm,
+				dnsmessage.RCodeSuccess,
+				anss,
+				nil,
+				replyStream,
+			)
+		}()
+
+		r, err := NewResolver(RoundRobin, "tcp://"+l.Addr().String())
+		if nil != err {
+			t.Fatalf("Unable to make resolver: %v", err)
+		}
+		r.LocalAddr(laddr)
+		lookupAFrom(t, r, want)
+		if from := (<-fch).(*net.TCPAddr); !laddr.Equal(from.IP) {
+			t.Errorf("Query came from %v, not %v", from, laddr)
+		}
+	})
+}
+
+func TestLocalAddrWrongFamily(t *testing.T) {
+	r, err := NewResolver(RoundRobin, "udp://127.0.0.1:1")
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+	r.LocalAddr(net.IPv6loopback)
+	_, err = r.LookupA("example.com")
+	if nil == err || !strings.Contains(
+		err.Error(),
+		"no suitable address found",
+	) {
+		t.Fatalf("Expected no suitable address error, got %v", err)
+	}
+}
+
+func TestDialControl(t *testing.T) {
+	errControl := errors.New("control called")
+	for scheme, want := range map[string]string{
+		"udp": "udp4",
+		"tcp": "tcp4",
+		"tls": "tcp4",
+	} {
+		scheme, want := scheme, want
+		t.Run(scheme, func(t *testing.T) {
+			r, err := NewResolver(
+				RoundRobin,
+				scheme+"://127.0.0.1:1",
+			)
+			if nil != err {
+				t.Fatalf("Unable to make resolver: %v", err)
+			}
+
+			/* Note the network and stop the dial */
+			nch := make(chan string, 1)
+			r.DialControl(func(
+				network string,
+				address string,
+				c syscall.RawConn,
+			) error {
+				nch <- network
+				return errControl
+			})
+
+			_, err = r.LookupA("example.com")
+			if !errors.Is(err, errControl) {
+				t.Fatalf("Expected control error, got %v", err)
+			}
+			if got := <-nch; want != got {
+				t.Errorf("Got network %q, not %q", got, want)
+			}
+		})
+	}
+}
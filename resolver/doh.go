@@ -0,0 +1,175 @@
+package resolver
+
+/*
+ * doh.go
+ * DNS over HTTPS
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* dohMIMEType is the MIME type for DNS messages, per RFC 8484 */
+const dohMIMEType = "application/dns-message"
+
+/* dohDefPath is the path used for DoH servers if none is given */
+const dohDefPath = "/dns-query"
+
+// HTTPClient sets the HTTP client used for DNS-over-HTTPS queries.
+func (r *resolver) HTTPClient(c *http.Client) {
+	r.optL.Lock()
+	defer r.optL.Unlock()
+	r.httpClient = c
+}
+
+/* defaultHTTPClient returns the client used for DoH if none has been set with
+HTTPClient.  It's like http.DefaultClient, but dials with r.dialer. */
+func (r *resolver) defaultHTTPClient() *http.Client {
+	r.dohOnce.Do(func() {
+		tr, ok := http.DefaultTransport.(*http.Transport)
+		if ok {
+			tr = tr.Clone()
+		} else {
+			tr = &http.Transport{Proxy: http.ProxyFromEnvironment}
+		}
+		tr.DialContext = func(
+			ctx context.Context,
+			network string,
+			addr string,
+		) (net.Conn, error) {
+			return r.dialer(network).DialContext(ctx, network, addr)
+		}
+		r.dohClient = &http.Client{Transport: tr}
+	})
+	return r.dohClient
+}
+
+/* dohAddr checks that the DoH server address a, which is the part of a URL
+after https://, has a host and adds the default path if it has none. */
+func dohAddr(a string) (string, error) {
+	u, err := url.Parse("https://" + a)
+	if nil != err {
+		return "", err
+	}
+	if "" == u.Host {
+		return "", fmt.Errorf("missing host in %q", a)
+	}
+	if "" == u.Path {
+		u.Path = dohDefPath
+	}
+	return u.Host + u.RequestURI(), nil
+}
+
+/* queryDoH sends qm to the DoH server s in a GET or POST request, per RFC
+8484. */
+func (r *resolver) queryDoH(
+	s serverAddr,
+	qm *dnsmessage.Message,
+) (*dnsmessage.Message, error) {
+	/* Work out which client to use and how long to wait */
+	r.optL.RLock()
+	hc := r.httpClient
+	r.optL.RUnlock()
+	if nil == hc {
+		hc = r.defaultHTTPClient()
+	}
+	r.qtoL.RLock()
+	to := r.qto
+	r.qtoL.RUnlock()
+
+	/* Roll the message.  The ID should be 0 to be cache-friendly. */
+	qm.Header.ID = 0
+	qbuf := r.bufpool.Get().([]byte)
+	defer r.bufpool.Put(qbuf)
+	m, err := qm.AppendPack(qbuf[:0])
+	if nil != err {
+		return nil, err
+	}
+
+	/* Send it off, in a GET request if the URL has a dns parameter and a
+	POST request otherwise. */
+	u, err := url.Parse(s.String())
+	if nil != err {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), to)
+	defer cancel()
+	var req *http.Request
+	if q := u.Query(); q.Has("dns") {
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(m))
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			u.String(),
+			nil,
+		)
+	} else {
+		req, err = http.NewRequestWithContext(
+			ctx,
+			http.MethodPost,
+			u.String(),
+			bytes.NewReader(m),
+		)
+	}
+	if nil != err {
+		return nil, err
+	}
+	if http.MethodPost == req.Method {
+		req.Header.Set("Content-Type", dohMIMEType)
+	}
+	req.Header.Set("Accept", dohMIMEType)
+	res, err := hc.Do(req)
+	if nil != err {
+		if nil != ctx.Err() {
+			return nil, ErrAnswerTimeout
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	/* Make sure we got a DNS message back */
+	if http.StatusOK != res.StatusCode {
+		return nil, fmt.Errorf("HTTP error: %s", res.Status)
+	}
+	ct := res.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); nil != err ||
+		dohMIMEType != mt {
+		return nil, fmt.Errorf("unexpected content type %q", ct)
+	}
+
+	/* Read and unmarshal it */
+	abuf := r.bufpool.Get().([]byte)
+	defer r.bufpool.Put(abuf)
+	n, err := io.ReadFull(res.Body, abuf)
+	if io.ErrUnexpectedEOF == err || io.EOF == err {
+		err = nil
+	} else if nil == err {
+		err = fmt.Errorf("reply too large")
+	}
+	if nil != err {
+		return nil, err
+	}
+	am := new(dnsmessage.Message)
+	if err := am.Unpack(abuf[:n]); nil != err {
+		return nil, fmt.Errorf(
+			"misbehaving server, unable to parse reply: %w",
+			err,
+		)
+	}
+
+	return am, nil
+}
@@ -0,0 +1,225 @@
+package resolver
+
+/*
+ * doh_test.go
+ * Make sure DNS over HTTPS works
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261017
+ */
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* newDoHServer returns a DoH server which answers A queries with addr.  The
+queries should be sent with the given method. */
+func newDoHServer(
+	t *testing.T,
+	method string,
+	addr [4]byte,
+) *httptest.Server {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		req *http.Request,
+	) {
+		/* Make sure the request looks right */
+		if method != req.Method {
+			t.Errorf("Unexpected method %v", req.Method)
+		}
+		if dohDefPath != req.URL.Path {
+			t.Errorf("Unexpected path %v", req.URL.Path)
+		}
+
+		/* Get the query */
+		var (
+			b   []byte
+			err error
+		)
+		switch req.Method {
+		case http.MethodGet:
+			b, err = base64.RawURLEncoding.DecodeString(
+				req.URL.Query().Get("dns"),
+			)
+		case http.MethodPost:
+			ct := req.Header.Get("Content-Type")
+			if dohMIMEType != ct {
+				t.Errorf("Unexpected content type %q", ct)
+			}
+			b, err = io.ReadAll(req.Body)
+		}
+		if nil != err {
+			t.Errorf("Error reading query: %v", err)
+			return
+		}
+		qm := new(dnsmessage.Message)
+		if err := qm.Unpack(b); nil != err {
+			t.Errorf("Unable to unpack query: %v", err)
+			return
+		}
+		if 0 != qm.Header.ID {
+			t.Errorf("Query has non-zero ID %v", qm.Header.ID)
+		}
+
+		/* Send back an answer */
+		am := &dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true},
+			Questions: qm.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name:  qm.Questions[0].Name,
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+				},
+				Body: &dnsmessage.AResource{A: addr},
+			}},
+		}
+		if b, err = am.Pack(); nil != err {
+			t.Errorf("Unable to pack answer: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", dohMIMEType)
+		w.Write(b)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestDoH(t *testing.T) {
+	want := [4]byte{192, 0, 2, 53}
+	s := newDoHServer(t, http.MethodPost, want)
+
+	r, err := NewResolver(RoundRobin, s.URL)
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+	r.HTTPClient(s.Client())
+
+	as, err := r.LookupA("example.com")
+	if nil != err {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if 1 != len(as) || want != as[0] {
+		t.Fatalf("Unexpected answer %v", as)
+	}
+}
+
+func TestDoHGET(t *testing.T) {
+	want := [4]byte{192, 0, 2, 54}
+	s := newDoHServer(t, http.MethodGet, want)
+
+	r, err := NewResolver(RoundRobin, s.URL+"?dns")
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+	r.HTTPClient(s.Client())
+
+	as, err := r.LookupA("example.com")
+	if nil != err {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if 1 != len(as) || want != as[0] {
+		t.Fatalf("Unexpected answer %v", as)
+	}
+}
+
+func TestDoHProxy(t *testing.T) {
+	want := [4]byte{192, 0, 2, 80}
+	s := newDoHServer(t, http.MethodPost, want)
+
+	/* Proxy which only allows CONNECT with the right credentials */
+	var nconn int32
+	pu := &url.URL{Scheme: "http", User: url.UserPassword("u", "p")}
+	p := httptest.NewServer(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		req *http.Request,
+	) {
+		if http.MethodConnect != req.Method {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		if "Basic dTpw" != req.Header.Get("Proxy-Authorization") {
+			http.Error(
+				w,
+				"bad auth",
+				http.StatusProxyAuthRequired,
+			)
+			return
+		}
+
+		/* Connect to the target and proxy */
+		tc, err := net.Dial("tcp", req.Host)
+		if nil != err {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer tc.Close()
+		pc, brw, err := w.(http.Hijacker).Hijack()
+		if nil != err {
+			t.Errorf("Unable to hijack proxy conn: %v", err)
+			return
+		}
+		defer pc.Close()
+		if _, err := io.WriteString(
+			pc,
+			"HTTP/1.1 200 Connection established\r\n\r\n",
+		); nil != err {
+			t.Errorf("Unable to send CONNECT reply: %v", err)
+			return
+		}
+		atomic.AddInt32(&nconn, 1)
+		go io.Copy(tc, brw) /* May have buffered some of the client's */
+		io.Copy(pc, tc)
+	}))
+	defer p.Close()
+	pu.Host = p.Listener.Addr().String()
+
+	/* Client which uses the proxy */
+	tr := s.Client().Transport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyURL(pu)
+	r, err := NewResolver(RoundRobin, s.URL)
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+	r.HTTPClient(&http.Client{Transport: tr})
+
+	as, err := r.LookupA("example.com")
+	if nil != err {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if 1 != len(as) || want != as[0] {
+		t.Fatalf("Unexpected answer %v", as)
+	}
+	if 1 != atomic.LoadInt32(&nconn) {
+		t.Fatalf("Query not sent through proxy")
+	}
+}
+
+func TestDoHDialControl(t *testing.T) {
+	s := newDoHServer(t, http.MethodPost, [4]byte{192, 0, 2, 55})
+
+	r, err := NewResolver(RoundRobin, s.URL)
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+
+	/* The default client should dial with our control function */
+	errCtl := errors.New("control called")
+	r.DialControl(func(network, address string, c syscall.RawConn) error {
+		return errCtl
+	})
+	if _, err := r.LookupA("example.com"); !errors.Is(err, errCtl) {
+		t.Fatalf("Expected error %v, got %v", errCtl, err)
+	}
+}
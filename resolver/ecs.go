@@ -0,0 +1,97 @@
+package resolver
+
+/*
+ * ecs.go
+ * EDNS Client Subnet
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261017
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	/* ednsUDPSize is the UDP payload size advertised in OPT records */
+	ednsUDPSize = 1232
+
+	/* ecsOptCode is the EDNS option code for Client Subnet, per RFC 7871 */
+	ecsOptCode = 8
+)
+
+// ClientSubnet sets the subnet sent in the EDNS Client Subnet option.
+func (r *resolver) ClientSubnet(subnet *net.IPNet) error {
+	/* Nil means don't send one */
+	if nil == subnet {
+		r.optL.Lock()
+		defer r.optL.Unlock()
+		r.ecs = nil
+		return nil
+	}
+
+	/* Work out the address family from the mask, so IPv4-mapped IPv6
+	subnets are sent as IPv6 */
+	var (
+		family uint16
+		ip     net.IP
+	)
+	ones, bits := subnet.Mask.Size()
+	switch bits {
+	case 8 * net.IPv4len:
+		family = 1
+		ip = subnet.IP.To4()
+	case 8 * net.IPv6len:
+		family = 2
+		ip = subnet.IP.To16()
+	default:
+		return errors.New("invalid subnet mask")
+	}
+	if nil == ip {
+		return errors.New("invalid subnet address")
+	}
+
+	/* Roll the option.  Only as many address bytes as are needed to hold
+	the prefix are sent, with the bits past the prefix zeroed. */
+	ip = ip.Mask(subnet.Mask)
+	data := make([]byte, 4, 4+len(ip))
+	binary.BigEndian.PutUint16(data, family)
+	data[2] = byte(ones) /* Source prefix length */
+	data[3] = 0          /* Scope prefix length, always 0 in queries */
+	data = append(data, ip[:(ones+7)/8]...)
+
+	r.optL.Lock()
+	defer r.optL.Unlock()
+	r.ecs = &dnsmessage.Option{Code: ecsOptCode, Data: data}
+	return nil
+}
+
+/* addEDNS adds an OPT record to qm if r has any EDNS options to send. */
+func (r *resolver) addEDNS(qm *dnsmessage.Message) error {
+	r.optL.RLock()
+	ecs := r.ecs
+	r.optL.RUnlock()
+	if nil == ecs {
+		return nil
+	}
+
+	/* Roll the OPT record */
+	var rh dnsmessage.ResourceHeader
+	if err := rh.SetEDNS0(
+		ednsUDPSize,
+		dnsmessage.RCodeSuccess,
+		false,
+	); nil != err {
+		return err
+	}
+	qm.Additionals = append(qm.Additionals, dnsmessage.Resource{
+		Header: rh,
+		Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{*ecs}},
+	})
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package resolver
+
+/*
+ * ecs_test.go
+ * Make sure the EDNS Client Subnet option is encoded properly
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestClientSubnet(t *testing.T) {
+	for _, c := range []struct {
+		subnet string
+		want   []byte
+	}{
+		{"192.0.2.0/24", []byte{0, 1, 24, 0, 192, 0, 2}},
+		{"192.0.2.128/25", []byte{0, 1, 25, 0, 192, 0, 2, 128}},
+		{"192.0.2.1/32", []byte{0, 1, 32, 0, 192, 0, 2, 1}},
+		{"0.0.0.0/0", []byte{0, 1, 0, 0}},
+		{"2001:db8::/32", []byte{0, 2, 32, 0, 0x20, 0x01, 0x0d, 0xb8}},
+		{"2001:db8:ff00::/40", []byte{
+			0, 2, 40, 0, 0x20, 0x01, 0x0d, 0xb8, 0xff,
+		}},
+		{"::/0", []byte{0, 2, 0, 0}},
+		{"::ffff:1.2.3.0/120", []byte{
+			0, 2, 120, 0,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 1, 2, 3,
+		}},
+	} {
+		_, n, err := net.ParseCIDR(c.subnet)
+		if nil != err {
+			t.Fatalf("Unable to parse %q: %v", c.subnet, err)
+		}
+		r := newResolver()
+		if err := r.ClientSubnet(n); nil != err {
+			t.Errorf("ClientSubnet(%v): %v", c.subnet, err)
+			continue
+		}
+		if ecsOptCode != r.ecs.Code {
+			t.Errorf("%v: option code %v", c.subnet, r.ecs.Code)
+		}
+		if !bytes.Equal(c.want, r.ecs.Data) {
+			t.Errorf(
+				"%v: got % 02x, want % 02x",
+				c.subnet,
+				r.ecs.Data,
+				c.want,
+			)
+		}
+	}
+}
+
+func TestClientSubnetInvalid(t *testing.T) {
+	for _, n := range []*net.IPNet{
+		{IP: net.IPv4(192, 0, 2, 0), Mask: net.IPMask{0xff, 0xff, 0xff}},
+		{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(24, 32)},
+	} {
+		if err := newResolver().ClientSubnet(n); nil == err {
+			t.Errorf("ClientSubnet(%v) succeeded", n)
+		}
+	}
+}
+
+func TestClientSubnetQuery(t *testing.T) {
+	r, _, qch, sc := newTestResolver(t)
+	want := [4]byte{192, 0, 2, 29}
+
+	/* lookup makes a query and returns it after answering it */
+	lookup := func() *dnsmessage.Message {
+		t.Helper()
+		res := goLookupA(r, "example.com")
+		qm := <-qch
+		if !reply(
+			t,
+			sc,
+			qm,
+			dnsmessage.RCodeSuccess,
+			[]dnsmessage.Resource{aRR("example.com.", want)},
+			nil,
+			0,
+		) {
+			t.FailNow()
+		}
+		if got := <-res; nil != got.err {
+			t.Fatalf("Lookup failed: %v", got.err)
+		}
+		return qm
+	}
+
+	/* With a subnet set, queries should have an OPT record */
+	_, n, err := net.ParseCIDR("192.0.2.0/24")
+	if nil != err {
+		t.Fatalf("Unable to parse subnet: %v", err)
+	}
+	if err := r.ClientSubnet(n); nil != err {
+		t.Fatalf("ClientSubnet: %v", err)
+	}
+	qm := lookup()
+	if 1 != len(qm.Additionals) {
+		t.Fatalf("Expected 1 additional record, got %v", qm.Additionals)
+	}
+	opt := qm.Additionals[0]
+	if dnsmessage.TypeOPT != opt.Header.Type {
+		t.Fatalf("Additional record has type %v", opt.Header.Type)
+	}
+	if ednsUDPSize != opt.Header.Class {
+		t.Errorf("UDP size %v, want %v", opt.Header.Class, ednsUDPSize)
+	}
+	ob, ok := opt.Body.(*dnsmessage.OPTResource)
+	if !ok {
+		t.Fatalf("OPT record has body type %T", opt.Body)
+	}
+	wantData := []byte{0, 1, 24, 0, 192, 0, 2}
+	if 1 != len(ob.Options) ||
+		ecsOptCode != ob.Options[0].Code ||
+		!bytes.Equal(wantData, ob.Options[0].Data) {
+		t.Errorf("Unexpected options %v", ob.Options)
+	}
+
+	/* Removing the subnet should remove the OPT record */
+	if err := r.ClientSubnet(nil); nil != err {
+		t.Fatalf("ClientSubnet(nil): %v", err)
+	}
+	if qm := lookup(); 0 != len(qm.Additionals) {
+		t.Errorf("Unexpected additional records %v", qm.Additionals)
+	}
+}
@@ -0,0 +1,78 @@
+package resolver
+
+/*
+ * idn.go
+ * Internationalized domain name handling
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+
+	"golang.org/x/net/idna"
+)
+
+/* idnaProfile is idna.Lookup, less the STD3 rules, which reject underscores in
+names like _sip._tcp.bücher.example. */
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.StrictDomainName(false),
+)
+
+/* toASCII converts name to its ASCII (punycode) form if it contains any
+non-ASCII characters.  Names which are already ASCII are returned unchanged, so
+as not to break names with underscores and the like. */
+func toASCII(name string) (string, error) {
+	/* Don't bother if it's already ASCII */
+	ascii := true
+	for i := 0; i < len(name); i++ {
+		if 0x80 <= name[i] {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return name, nil
+	}
+
+	/* Convert to punycode */
+	a, err := idnaProfile.ToASCII(name)
+	if nil != err {
+		return "", fmt.Errorf("converting %q to ASCII: %w", name, err)
+	}
+	return a, nil
+}
+
+/* toUnicode converts name from punycode to Unicode if r is configured to
+return Unicode names.  If the conversion fails, name is returned unchanged. */
+func (r *resolver) toUnicode(name string) string {
+	r.optL.RLock()
+	defer r.optL.RUnlock()
+	if !r.unicode {
+		return name
+	}
+	u, err := idna.Display.ToUnicode(name)
+	if nil != err {
+		return name
+	}
+	return u
+}
+
+/* toUnicodes calls r.toUnicode on every element of names. */
+func (r *resolver) toUnicodes(names []string) []string {
+	for i, n := range names {
+		names[i] = r.toUnicode(n)
+	}
+	return names
+}
+
+// UnicodeNames sets whether names in returned records are converted from
+// punycode to Unicode.
+func (r *resolver) UnicodeNames(on bool) {
+	r.optL.Lock()
+	defer r.optL.Unlock()
+	r.unicode = on
+}
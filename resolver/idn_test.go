@@ -0,0 +1,158 @@
+package resolver
+
+/*
+ * idn_test.go
+ * Make sure names are converted to punycode properly
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestToASCII(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com.", "example.com."},
+		{"Example.COM", "Example.COM"},
+		{"_sip._tcp.example.com", "_sip._tcp.example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"bücher.example.", "xn--bcher-kva.example."},
+		{"Bücher.Example", "xn--bcher-kva.example"},
+		{"_sip._tcp.bücher.example", "_sip._tcp.xn--bcher-kva.example"},
+		{"_sip._tcp.bücher.example.", "_sip._tcp.xn--bcher-kva.example."},
+	} {
+		got, err := toASCII(c.name)
+		if nil != err {
+			t.Errorf("toASCII(%q): %v", c.name, err)
+			continue
+		}
+		if c.want != got {
+			t.Errorf(
+				"toASCII(%q): got %q, want %q",
+				c.name,
+				got,
+				c.want,
+			)
+		}
+	}
+}
+
+/* rr returns a record of the given type for owner. */
+func rr(
+	owner string,
+	typ dnsmessage.Type,
+	body dnsmessage.ResourceBody,
+) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(owner),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		},
+		Body: body,
+	}
+}
+
+func TestUnicodeNames(t *testing.T) {
+	puny := dnsmessage.MustNewName("xn--bcher-kva.example.")
+	r, _ := newTestZone(
+		t,
+		false,
+		rr("cname.example.", dnsmessage.TypeCNAME,
+			&dnsmessage.CNAMEResource{CNAME: puny}),
+		rr("ns.example.", dnsmessage.TypeNS,
+			&dnsmessage.NSResource{NS: puny}),
+		rr("mx.example.", dnsmessage.TypeMX,
+			&dnsmessage.MXResource{Pref: 10, MX: puny}),
+		rr("srv.example.", dnsmessage.TypeSRV,
+			&dnsmessage.SRVResource{Port: 5060, Target: puny}),
+		rr("1.2.0.192.in-addr.arpa.", dnsmessage.TypePTR,
+			&dnsmessage.PTRResource{PTR: puny}),
+	)
+
+	/* lookups returns the name returned by each Lookup method */
+	lookups := func() map[string]string {
+		t.Helper()
+		got := make(map[string]string)
+		one := func(which string, ns []string, err error) {
+			t.Helper()
+			if nil != err {
+				t.Fatalf("%v failed: %v", which, err)
+			}
+			if 1 != len(ns) {
+				t.Fatalf("%v returned %q", which, ns)
+			}
+			got[which] = ns[0]
+		}
+		ns, err := r.LookupCNAME("cname.example")
+		one("LookupCNAME", ns, err)
+		ns, err = r.LookupNS("ns.example")
+		one("LookupNS", ns, err)
+		mxs, err := r.LookupMX("mx.example")
+		ns = nil
+		for _, mx := range mxs {
+			ns = append(ns, mx.Name)
+		}
+		one("LookupMX", ns, err)
+		srvs, err := r.LookupSRV("srv.example")
+		ns = nil
+		for _, srv := range srvs {
+			ns = append(ns, srv.Target)
+		}
+		one("LookupSRV", ns, err)
+		ns, err = r.LookupPTR(net.IPv4(192, 0, 2, 1))
+		one("LookupPTR", ns, err)
+		return got
+	}
+
+	/* Punycode by default, Unicode when asked */
+	for _, c := range []struct {
+		on   bool
+		want string
+	}{
+		{false, "xn--bcher-kva.example."},
+		{true, "bücher.example."},
+		{false, "xn--bcher-kva.example."},
+	} {
+		r.UnicodeNames(c.on)
+		for which, got := range lookups() {
+			if c.want != got {
+				t.Errorf(
+					"%v (Unicode %v): got %q, want %q",
+					which,
+					c.on,
+					got,
+					c.want,
+				)
+			}
+		}
+	}
+}
+
+func TestIDNQuery(t *testing.T) {
+	r, z := newTestZone(t, false)
+
+	/* Non-ASCII names should go out as punycode */
+	if _, err := r.LookupA("Bücher.example"); nil != err {
+		t.Fatalf("LookupA failed: %v", err)
+	}
+	if _, err := r.LookupSRV("_sip._tcp.bücher.example."); nil != err {
+		t.Fatalf("LookupSRV failed: %v", err)
+	}
+	if want := []string{
+		"xn--bcher-kva.example.",
+		"_sip._tcp.xn--bcher-kva.example.",
+	}; !reflect.DeepEqual(want, z.queries()) {
+		t.Fatalf("Expected queries for %q, got %q", want, z.queries())
+	}
+}
@@ -5,7 +5,7 @@ package resolver
  * LookupX methods
  * By J. Stuart McMurray
  * Created 20180926
- * Last Modified 20181003
+ * Last Modified 20261016
  */
 
 import (
@@ -46,7 +46,7 @@ func (r *resolver) LookupAC(name string) ([]string, error) {
 		cs[i] = r.Body.(*dnsmessage.CNAMEResource).CNAME.String()
 	}
 
-	return cs, nil
+	return r.toUnicodes(cs), nil
 }
 
 // LookupNS looks up NS records
@@ -63,7 +63,7 @@ func (r *resolver) LookupNS(name string) ([]string, error) {
 		as[i] = r.Body.(*dnsmessage.NSResource).NS.String()
 	}
 
-	return as, nil
+	return r.toUnicodes(as), nil
 }
 
 // LookupCNAME looks up CNAME records
@@ -80,7 +80,7 @@ func (r *resolver) LookupCNAME(name string) ([]string, error) {
 		as[i] = r.Body.(*dnsmessage.CNAMEResource).CNAME.String()
 	}
 
-	return as, nil
+	return r.toUnicodes(as), nil
 }
 
 // LookupPTR looks up PTR (IP-to-name) records
@@ -101,7 +101,7 @@ func (r *resolver) LookupPTR(addr net.IP) ([]string, error) {
 		as[i] = r.Body.(*dnsmessage.PTRResource).PTR.String()
 	}
 
-	return as, nil
+	return r.toUnicodes(as), nil
 }
 
 // LookupMX looks up MX records
@@ -122,6 +122,11 @@ func (r *resolver) LookupMX(name string) ([]MX, error) {
 		}
 	}
 
+	/* Convert names to Unicode, maybe */
+	for i := range as {
+		as[i].Name = r.toUnicode(as[i].Name)
+	}
+
 	return as, nil
 }
 
@@ -173,7 +178,7 @@ func (r *resolver) LookupAAAAC(name string) ([]string, error) {
 		cs[i] = r.Body.(*dnsmessage.CNAMEResource).CNAME.String()
 	}
 
-	return cs, nil
+	return r.toUnicodes(cs), nil
 }
 
 // LookupSRV looks up SRV records
@@ -196,5 +201,10 @@ func (r *resolver) LookupSRV(name string) ([]SRV, error) {
 		}
 	}
 
+	/* Convert names to Unicode, maybe */
+	for i := range as {
+		as[i].Target = r.toUnicode(as[i].Target)
+	}
+
 	return as, nil
 }
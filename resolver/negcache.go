@@ -0,0 +1,125 @@
+package resolver
+
+/*
+ * negcache.go
+ * Cache of nonexistent names
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261017
+ */
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* negCacheSize is the maximum number of names in the negative cache */
+const negCacheSize = 4096
+
+// CacheNXDomain sets the maximum time for which NXDOMAIN replies are cached.
+func (r *resolver) CacheNXDomain(max time.Duration) {
+	r.negCacheL.Lock()
+	defer r.negCacheL.Unlock()
+	r.negCacheMax = max
+
+	/* If we're not caching, don't hold on to what we have */
+	if 0 >= max {
+		r.negCache = nil
+	}
+}
+
+/* negCacheEntry is an entry in the negative cache */
+type negCacheEntry struct {
+	exp time.Time     /* Expiry */
+	err *ResolveError /* Error to return */
+}
+
+/* cachedNXDomain returns the error to return if name is in the negative cache
+and hasn't expired, or nil if it isn't. */
+func (r *resolver) cachedNXDomain(name string) *ResolveError {
+	r.negCacheL.Lock()
+	defer r.negCacheL.Unlock()
+
+	/* Don't bother if we're not caching */
+	if nil == r.negCache {
+		return nil
+	}
+
+	/* See if we have it, and if it's still good */
+	name = strings.ToLower(name)
+	e, ok := r.negCache[name]
+	if !ok {
+		return nil
+	}
+	if r.clock.now().After(e.exp) {
+		delete(r.negCache, name)
+		return nil
+	}
+
+	/* Return a copy, lest the caller modify the cached one */
+	re := *e.err
+	return &re
+}
+
+/* cacheNXDomain adds name to the negative cache, using the SOA record in
+auths for the TTL per RFC 2308.  Subsequent lookups for the name will return
+re.  If there is no SOA record, name isn't cached. */
+func (r *resolver) cacheNXDomain(
+	name string,
+	auths []dnsmessage.Resource,
+	re *ResolveError,
+) {
+	r.negCacheL.Lock()
+	defer r.negCacheL.Unlock()
+
+	/* Don't bother if we're not caching */
+	if 0 >= r.negCacheMax {
+		return
+	}
+
+	/* The TTL is the lesser of the SOA's TTL and its MINIMUM field */
+	var ttl time.Duration
+	for _, a := range auths {
+		soa, ok := a.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+		m := a.Header.TTL
+		if soa.MinTTL < m {
+			m = soa.MinTTL
+		}
+		ttl = time.Duration(m) * time.Second
+		break
+	}
+	if 0 == ttl {
+		return
+	}
+	if r.negCacheMax < ttl {
+		ttl = r.negCacheMax
+	}
+
+	/* Make room if we need it */
+	if nil == r.negCache {
+		r.negCache = make(map[string]negCacheEntry)
+	}
+	if negCacheSize <= len(r.negCache) {
+		now := r.clock.now()
+		for n, e := range r.negCache {
+			if now.After(e.exp) {
+				delete(r.negCache, n)
+			}
+		}
+	}
+	if negCacheSize <= len(r.negCache) {
+		return
+	}
+
+	/* Store a copy, as re goes back to the caller */
+	cre := *re
+	r.negCache[strings.ToLower(name)] = negCacheEntry{
+		exp: r.clock.now().Add(ttl),
+		err: &cre,
+	}
+}
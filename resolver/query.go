@@ -5,7 +5,7 @@ package resolver
  * perform a query
  * By J. Stuart McMurray
  * Created 20180926
- * Last Modified 20181013
+ * Last Modified 20261017
  */
 
 import (
@@ -17,7 +17,8 @@ import (
 )
 
 // The following errors correspond to non-success (i.e. not NOERROR) Response
-// Codes returned from DNS servers.
+// Codes returned from DNS servers.  They are returned wrapped in a
+// *ResolveError; use errors.Is to check for them.
 var (
 	ErrRCFormErr  = errors.New("formerr")  /* Format Error */
 	ErrRCServFail = errors.New("servfail") /* Server Failure */
@@ -30,8 +31,18 @@ var (
 // elapsed.
 var ErrAnswerTimeout = errors.New("timeout waiting for answer")
 
+// ErrCNAMELoop is returned if a CNAME chain being followed loops back on
+// itself.
+var ErrCNAMELoop = errors.New("CNAME loop")
+
+// ErrCNAMEChainTooLong is returned if a CNAME chain being followed is longer
+// than the limit set with FollowCNAMEs.
+var ErrCNAMEChainTooLong = errors.New("CNAME chain too long")
+
 /* query makes a query for the name and given type and returns all of the
-answers of type atype it gets. */
+answers of type atype it gets.  If r is configured to follow CNAMEs and atype
+isn't TypeCNAME, answers for names at the end of a CNAME chain are returned as
+well. */
 func (r *resolver) query(
 	name string,
 	qtype dnsmessage.Type,
@@ -39,10 +50,77 @@ func (r *resolver) query(
 ) ([]dnsmessage.Resource, error) {
 	var err error
 
-	/* Roll query */
+	/* Normalize the name */
+	if name, err = toASCII(name); nil != err {
+		return nil, newResolveError("", nil, err)
+	}
 	if !strings.HasSuffix(name, ".") {
 		name += "."
 	}
+
+	/* Work out how far to follow CNAMEs */
+	r.optL.RLock()
+	depth := r.cnameDepth
+	r.optL.RUnlock()
+	if dnsmessage.TypeCNAME == atype {
+		depth = 0
+	}
+
+	/* Names which may own answers we return */
+	owners := map[string]bool{strings.ToLower(name): true}
+
+	for {
+		/* Ask about the current end of the chain */
+		anss, err := r.exchange(name, qtype)
+		if nil != err {
+			return nil, err
+		}
+
+		/* If we're not following CNAMEs, we're done */
+		if 0 >= depth {
+			return filterAnswers(anss, owners, atype), nil
+		}
+
+		/* Follow the chain as far as the answers take us */
+		target := name
+		for {
+			cname, ok := findCNAME(anss, target)
+			if !ok {
+				break
+			}
+			if owners[strings.ToLower(cname)] {
+				return nil, newResolveError("", nil, ErrCNAMELoop)
+			}
+			if len(owners) > depth {
+				return nil, newResolveError(
+					"",
+					nil,
+					ErrCNAMEChainTooLong,
+				)
+			}
+			owners[strings.ToLower(cname)] = true
+			target = cname
+		}
+
+		/* If we got answers or there's nowhere left to go, we're
+		done.  Otherwise, ask about the end of the chain. */
+		rs := filterAnswers(anss, owners, atype)
+		if 0 != len(rs) || target == name {
+			return rs, nil
+		}
+		name = target
+	}
+}
+
+/* exchange sends a query for the name and given type to the server(s) and
+returns the answers it gets back.  Returned errors are *ResolveErrors. */
+func (r *resolver) exchange(
+	name string,
+	qtype dnsmessage.Type,
+) ([]dnsmessage.Resource, error) {
+	var err error
+
+	/* Roll query */
 	qm := &dnsmessage.Message{
 		Header: dnsmessage.Header{RecursionDesired: true},
 		Questions: []dnsmessage.Question{{
@@ -52,21 +130,35 @@ func (r *resolver) query(
 	}
 	qm.Questions[0].Name, err = dnsmessage.NewName(name)
 	if nil != err {
-		return nil, err
+		return nil, newResolveError("", nil, err)
+	}
+	if err := r.addEDNS(qm); nil != err {
+		return nil, newResolveError("", nil, err)
+	}
+
+	/* If we already know the name doesn't exist, don't bother asking */
+	if re := r.cachedNXDomain(name); nil != re {
+		return nil, re
+	}
+
+	/* If too many queries have failed lately, don't bother either */
+	probe, err := r.breakerAllow()
+	if nil != err {
+		return nil, newResolveError("", nil, err)
 	}
 
 	/* Send it out as appropriate */
 	var (
-		anss  []dnsmessage.Resource
-		rcode dnsmessage.RCode
+		am     *dnsmessage.Message
+		server string
 	)
 	switch r.queryMethod {
 	case RoundRobin:
-		anss, rcode, err = r.roundRobin(qm)
+		am, server, err = r.roundRobin(qm)
 	case NextOnFail:
-		anss, rcode, err = r.nextOnFail(qm)
+		am, server, err = r.nextOnFail(qm)
 	case QueryAll:
-		anss, rcode, err = r.queryAll(qm)
+		am, server, err = r.queryAll(qm)
 	default:
 		panic(
 			"unknown query method " +
@@ -74,28 +166,64 @@ func (r *resolver) query(
 		)
 	}
 	if nil != err {
-		return nil, err
+		r.breakerNote(err, probe)
+		return nil, newResolveError(server, nil, err)
 	}
 
 	/* If we got a non-success rcode, return that */
-	switch rcode {
+	switch am.Header.RCode {
 	case dnsmessage.RCodeFormatError:
-		return nil, ErrRCFormErr
+		err = ErrRCFormErr
 	case dnsmessage.RCodeServerFailure:
-		return nil, ErrRCServFail
+		err = ErrRCServFail
 	case dnsmessage.RCodeNameError:
-		return nil, ErrRCNXDomain
+		err = ErrRCNXDomain
 	case dnsmessage.RCodeNotImplemented:
-		return nil, ErrRCNotImp
+		err = ErrRCNotImp
 	case dnsmessage.RCodeRefused:
-		return nil, ErrRCRefused
+		err = ErrRCRefused
+	}
+	r.breakerNote(err, probe)
+	if nil != err {
+		re := newResolveError(server, am, err)
+		/* The NXDOMAIN is for the end of the chain if name's an
+		alias, not name itself. */
+		if _, isAlias := findCNAME(am.Answers, name); !isAlias &&
+			dnsmessage.RCodeNameError == am.Header.RCode {
+			r.cacheNXDomain(name, am.Authorities, re)
+		}
+		return nil, re
+	}
+
+	return am.Answers, nil
+}
+
+/* findCNAME returns the target of the CNAME record for name in anss, if
+there is one. */
+func findCNAME(anss []dnsmessage.Resource, name string) (string, bool) {
+	for _, ans := range anss {
+		c, ok := ans.Body.(*dnsmessage.CNAMEResource)
+		if !ok || !strings.EqualFold(ans.Header.Name.String(), name) {
+			continue
+		}
+		return c.CNAME.String(), true
 	}
+	return "", false
+}
 
+/* filterAnswers removes the answers in anss which aren't of type atype or
+whose names aren't in owners, which must be lowercase.  The filtered slice is
+returned.  The underlying array is modified. */
+func filterAnswers(
+	anss []dnsmessage.Resource,
+	owners map[string]bool,
+	atype dnsmessage.Type,
+) []dnsmessage.Resource {
 	/* Filter output by ans.Header.Type */
 	last := 0
 	for _, ans := range anss {
 		/* Make sure answer comes back for the right name */
-		if ans.Header.Name.String() != name {
+		if !owners[strings.ToLower(ans.Header.Name.String())] {
 			continue
 		}
 
@@ -143,114 +271,133 @@ func (r *resolver) query(
 		anss[last] = ans
 		last++
 	}
-	anss = anss[:last]
 
-	return anss[:last], nil
+	return anss[:last]
 }
 
-/* roundRobin tries each server in turn */
+/* roundRobin tries each server in turn.  The server queried is returned
+with the reply. */
 func (r *resolver) roundRobin(qm *dnsmessage.Message) (
-	[]dnsmessage.Resource,
-	dnsmessage.RCode,
+	*dnsmessage.Message,
+	string,
 	error,
 ) {
 	/* If we were passed-in a conn and no address, use that */
 	if 1 == len(r.conns) && nil == r.servers {
 		/* Even if we get an error back, never remove the conn so that
 		each query will return the error. */
-		return r.conns[0].query(qm)
+		am, err := r.conns[0][0].query(qm)
+		return am, r.conns[0][0].server, err
 	}
 
-	/* Try the next conn in the list */
-	c, err := r.nextRRConn()
-	if nil != err {
-		return nil, 0xFFFF, err
-	}
-	return c.query(qm)
+	/* Try the next server in the list */
+	return r.queryServer(r.nextRRIndex(), qm)
 }
 
-/* nextOnFail queries all of the resolvers in turn */
-func (r *resolver) nextOnFail(qm *dnsmessage.Message) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+/* nextOnFail queries all of the resolvers in turn.  The last server queried
+is returned with the reply. */
+func (r *resolver) nextOnFail(qm *dnsmessage.Message) (
+	*dnsmessage.Message,
+	string,
+	error,
+) {
 	var (
-		c   *conn
-		rs  []dnsmessage.Resource
-		rc  dnsmessage.RCode
-		err error
+		am     *dnsmessage.Message
+		server string
+		err    error
 	)
 	/* Try each server in turn */
-	for i := 0; 0 == len(rs) && len(r.servers) > i; i++ {
-		c, err = r.getOrDialConn(i)
-		if nil != err {
-			/* TODO: Can we find something better to do here? */
-			continue
-		}
-		rs, rc, err = c.query(qm)
+	for i := 0; (nil == am || 0 == len(am.Answers)) &&
+		len(r.servers) > i; i++ {
+		am, server, err = r.queryServer(i, qm)
+	}
+	if nil == am && nil == err {
+		err = errors.New("no servers queried")
 	}
-	return rs, rc, err
+	return am, server, err
 }
 
-/* queryAll queries all of the resolvers simultaneously */
-func (r *resolver) queryAll(qm *dnsmessage.Message) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+/* queryAll queries all of the resolvers simultaneously.  The server which
+sent the reply whose rcode is used is returned with the merged reply. */
+func (r *resolver) queryAll(qm *dnsmessage.Message) (
+	*dnsmessage.Message,
+	string,
+	error,
+) {
 	var (
 		err  error
 		n    int /* Number of servers queried */
-		rsch = make(chan []dnsmessage.Resource)
-		rcch = make(chan dnsmessage.RCode)
+		amch = make(chan *dnsmessage.Message)
+		sch  = make(chan string)
 		ech  = make(chan error)
 	)
 	/* Fire off all the queries */
 	for i := range r.servers {
-		/* Grab a conn */
-		var c *conn
-		c, err = r.getOrDialConn(i)
-		if nil != err {
-			continue
-		}
 		/* New query, to prevent IDs being overwritten */
 		q := *qm
 		/* Do the query */
-		go func() {
-			ors, orc, oerr := c.query(&q)
-			rsch <- ors
-			rcch <- orc
+		go func(i int) {
+			oam, oserver, oerr := r.queryServer(i, &q)
+			amch <- oam
+			sch <- oserver
 			ech <- oerr
-		}()
+		}(i)
 		n++
 	}
 
 	/* Gather query results */
 	var (
-		success bool /* True if we got a non-nxdomain */
-		rs      []dnsmessage.Resource
-		rc      dnsmessage.RCode
+		success bool   /* True if we got a non-nxdomain */
+		got     bool   /* True if we got any reply at all */
+		server  string /* Server whose rcode we use */
+		eserver string /* Server which sent err */
+		am      = &dnsmessage.Message{Header: qm.Header}
 	)
+	am.Header.Response = true
+	am.Questions = qm.Questions
 	for i := 0; i < n; i++ {
-		/* Get any resources we have */
-		trs := <-rsch
-		if nil != trs {
-			rs = append(rs, trs...)
+		/* Get any resources we have.  We'll use the last rcode we
+		get. */
+		tam := <-amch
+		tserver := <-sch
+		if nil != tam && !success {
+			server = tserver
+			am.Header.RCode = tam.Header.RCode
+			am.Header.Authoritative = tam.Header.Authoritative
+			/* Though, if any of them are SUCCESS, use that */
+			if dnsmessage.RCodeSuccess == tam.Header.RCode {
+				success = true
+			}
 		}
-
-		/* Get an rcode, we'll return the last one we get */
-		rc = <-rcch
-		/* Though, if any of them are SUCCESS, use that */
-		if dnsmessage.RCodeSuccess == rc {
-			success = true
+		if nil != tam {
+			got = true
+			am.Answers = append(am.Answers, tam.Answers...)
+			am.Authorities = append(
+				am.Authorities,
+				tam.Authorities...,
+			)
 		}
 
-		/* We'll also use the last error we got. */
-		err = <-ech
+		/* We'll also use the last error we got, and who sent it. */
+		if terr := <-ech; nil != terr {
+			err = terr
+			eserver = tserver
+		}
 	}
 
-	/* If we at all got answers, we have success */
-	if 0 != len(rs) {
+	/* If we at all got answers, that counts as success */
+	if 0 != len(am.Answers) {
+		am.Header.RCode = dnsmessage.RCodeSuccess
+	}
+	/* If we at all got a reply, we have success */
+	if got {
 		err = nil
-		rc = dnsmessage.RCodeSuccess
+	} else if nil == err {
+		err = errors.New("no servers queried")
 	}
-	/* If we had a SUCCESS but no answers, that counts */
-	if success {
-		rc = dnsmessage.RCodeSuccess
+	if nil != err {
+		return nil, eserver, err
 	}
 
-	return rs, rc, err
+	return am, server, nil
 }
@@ -0,0 +1,218 @@
+package resolver
+
+/*
+ * query_test.go
+ * Make sure CNAME chains are followed
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* testZone answers queries with the records for the queried name and notes
+which names were queried. */
+type testZone struct {
+	recs    map[string][]dnsmessage.Resource /* Keys are lowercase */
+	follow  bool                             /* Follow CNAME chains */
+	queried []string
+	l       sync.Mutex
+}
+
+/* newTestZone returns a resolver which gets its answers from recs, which
+should be in order, and the testZone which holds them.  If follow is true,
+answers include the rest of the CNAME chain, as from a recursive server. */
+func newTestZone(
+	t *testing.T,
+	follow bool,
+	recs ...dnsmessage.Resource,
+) (*resolver, *testZone) {
+	r, _, qch, sc := newTestResolver(t)
+	z := &testZone{
+		recs:   make(map[string][]dnsmessage.Resource),
+		follow: follow,
+	}
+	for _, rec := range recs {
+		n := strings.ToLower(rec.Header.Name.String())
+		z.recs[n] = append(z.recs[n], rec)
+	}
+
+	/* Answer queries */
+	go func() {
+		for qm := range qch {
+			n := strings.ToLower(qm.Questions[0].Name.String())
+			z.l.Lock()
+			z.queried = append(z.queried, n)
+			z.l.Unlock()
+			if !reply(
+				t,
+				sc,
+				qm,
+				dnsmessage.RCodeSuccess,
+				z.answers(n),
+				nil,
+				0,
+			) {
+				return
+			}
+		}
+	}()
+
+	return r, z
+}
+
+/* answers returns the records with which to answer a query for n, which
+should be lowercase. */
+func (z *testZone) answers(n string) []dnsmessage.Resource {
+	var anss []dnsmessage.Resource
+	for seen := make(map[string]bool); !seen[n]; {
+		seen[n] = true
+		for _, rec := range z.recs[n] {
+			anss = append(anss, rec)
+			c, ok := rec.Body.(*dnsmessage.CNAMEResource)
+			if ok && z.follow {
+				n = strings.ToLower(c.CNAME.String())
+			}
+		}
+	}
+	return anss
+}
+
+/* queries returns the names queried so far. */
+func (z *testZone) queries() []string {
+	z.l.Lock()
+	defer z.l.Unlock()
+	return append([]string(nil), z.queried...)
+}
+
+/* cnameRR returns a CNAME record pointing owner at target. */
+func cnameRR(owner, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(owner),
+			Type:  dnsmessage.TypeCNAME,
+			Class: dnsmessage.ClassINET,
+		},
+		Body: &dnsmessage.CNAMEResource{
+			CNAME: dnsmessage.MustNewName(target),
+		},
+	}
+}
+
+/* aRR returns an A record for owner. */
+func aRR(owner string, a [4]byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(owner),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		},
+		Body: &dnsmessage.AResource{A: a},
+	}
+}
+
+func TestFollowCNAMEsLoop(t *testing.T) {
+	r, _ := newTestZone(
+		t,
+		true,
+		cnameRR("a.example.com.", "b.example.com."),
+		cnameRR("b.example.com.", "A.Example.COM."),
+	)
+	r.FollowCNAMEs(10)
+	if _, err := r.LookupA("a.example.com"); !errors.Is(
+		err,
+		ErrCNAMELoop,
+	) {
+		t.Fatalf("Expected %v, got %v", ErrCNAMELoop, err)
+	}
+}
+
+func TestFollowCNAMEsTooLong(t *testing.T) {
+	want := [4]byte{192, 0, 2, 3}
+	r, _ := newTestZone(
+		t,
+		true,
+		cnameRR("c0.example.com.", "c1.example.com."),
+		cnameRR("c1.example.com.", "c2.example.com."),
+		cnameRR("c2.example.com.", "c3.example.com."),
+		aRR("c3.example.com.", want),
+	)
+
+	/* Three CNAMEs is one too many */
+	r.FollowCNAMEs(2)
+	if _, err := r.LookupA("c0.example.com"); !errors.Is(
+		err,
+		ErrCNAMEChainTooLong,
+	) {
+		t.Fatalf("Expected %v, got %v", ErrCNAMEChainTooLong, err)
+	}
+
+	/* But just enough with a higher limit */
+	r.FollowCNAMEs(3)
+	as, err := r.LookupA("c0.example.com")
+	if nil != err {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if 1 != len(as) || want != as[0] {
+		t.Fatalf("Unexpected answer %v", as)
+	}
+}
+
+func TestFollowCNAMEsDisabled(t *testing.T) {
+	r, z := newTestZone(
+		t,
+		true,
+		cnameRR("alias.example.com.", "target.example.com."),
+		aRR("target.example.com.", [4]byte{192, 0, 2, 4}),
+	)
+
+	/* The A record isn't for the name we asked about */
+	as, err := r.LookupA("alias.example.com")
+	if nil != err {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if 0 != len(as) {
+		t.Fatalf("Unexpected answer %v", as)
+	}
+	if want := []string{"alias.example.com."}; !reflect.DeepEqual(
+		want,
+		z.queries(),
+	) {
+		t.Fatalf("Expected queries for %q, got %q", want, z.queries())
+	}
+}
+
+func TestFollowCNAMEsRequery(t *testing.T) {
+	want := [4]byte{192, 0, 2, 5}
+	r, z := newTestZone(
+		t,
+		false,
+		cnameRR("ALIAS.example.com.", "Target.Example.COM."),
+		aRR("TARGET.example.com.", want),
+	)
+	r.FollowCNAMEs(5)
+
+	/* The server doesn't follow the chain, so we'll have to ask about the
+	target ourselves. */
+	as, err := r.LookupA("alias.EXAMPLE.com")
+	if nil != err {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if 1 != len(as) || want != as[0] {
+		t.Fatalf("Unexpected answer %v", as)
+	}
+	if want := []string{
+		"alias.example.com.",
+		"target.example.com.",
+	}; !reflect.DeepEqual(want, z.queries()) {
+		t.Fatalf("Expected queries for %q, got %q", want, z.queries())
+	}
+}
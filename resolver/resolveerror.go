@@ -0,0 +1,83 @@
+package resolver
+
+/*
+ * resolveerror.go
+ * Error with information about the server
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261016
+ */
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// RCodeNone is used as a ResolveError's RCode if no reply was received.
+const RCodeNone dnsmessage.RCode = 0xFFFF
+
+// ResolveError is returned by the Lookup* methods of Resolvers returned by
+// NewResolver and NewResolverFromConn.  It wraps the underlying error, which
+// may be one of the ErrRC* errors, ErrAnswerTimeout, or an error from the
+// network.  Use errors.Is to check for specific errors.
+type ResolveError struct {
+	// Server is the server which returned the error, if known.
+	Server string
+
+	// RCode is the Response Code in the reply from Server, or RCodeNone
+	// if no reply was received.
+	RCode dnsmessage.RCode
+
+	// Authoritative is true if the reply had the Authoritative Answer
+	// bit set.
+	Authoritative bool
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *ResolveError) Error() string {
+	var sb strings.Builder
+	if "" != e.Server {
+		sb.WriteString(e.Server)
+		sb.WriteString(": ")
+	}
+	sb.WriteString(e.Err.Error())
+	if e.Authoritative {
+		sb.WriteString(" (authoritative)")
+	}
+	return sb.String()
+}
+
+// Unwrap returns e.Err.
+func (e *ResolveError) Unwrap() error { return e.Err }
+
+/* newResolveError wraps err in a ResolveError from the given server.  If am
+is not nil, the ResolveError's RCode and Authoritative fields are populated
+from it.  If err is already a ResolveError, it is returned unchanged. */
+func newResolveError(
+	server string,
+	am *dnsmessage.Message,
+	err error,
+) *ResolveError {
+	/* Don't double-wrap */
+	var re *ResolveError
+	if errors.As(err, &re) {
+		return re
+	}
+
+	re = &ResolveError{
+		Server: server,
+		RCode:  RCodeNone,
+		Err:    err,
+	}
+	if nil != am {
+		re.RCode = am.Header.RCode
+		re.Authoritative = am.Header.Authoritative
+	}
+
+	return re
+}
@@ -0,0 +1,207 @@
+package resolver
+
+/*
+ * resolveerror_test.go
+ * Make sure ResolveErrors are populated
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolveErrorNXDomain(t *testing.T) {
+	r, _, qch, sc := newTestResolver(t)
+	r.CacheNXDomain(time.Hour)
+
+	/* Answer with an authoritative NXDOMAIN */
+	go func() {
+		qm := <-qch
+		reply(t, sc, qm, dnsmessage.RCodeNameError, nil,
+			[]dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name:  dnsmessage.MustNewName("com."),
+					Type:  dnsmessage.TypeSOA,
+					Class: dnsmessage.ClassINET,
+					TTL:   300,
+				},
+				Body: &dnsmessage.SOAResource{
+					NS:     dnsmessage.MustNewName("ns.com."),
+					MBox:   dnsmessage.MustNewName("h.com."),
+					MinTTL: 300,
+				},
+			}}, replyAA)
+	}()
+
+	/* lookup does a lookup and checks the returned error */
+	lookup := func() *ResolveError {
+		t.Helper()
+		_, err := r.LookupA("nx.example.com")
+		if !errors.Is(err, ErrRCNXDomain) {
+			t.Fatalf("Expected NXDOMAIN, got %v", err)
+		}
+		var re *ResolveError
+		if !errors.As(err, &re) {
+			t.Fatalf("Error %v (%T) isn't a *ResolveError", err, err)
+		}
+		if want := sc.LocalAddr().String(); want != re.Server {
+			t.Errorf("Expected server %q, got %q", want, re.Server)
+		}
+		if dnsmessage.RCodeNameError != re.RCode {
+			t.Errorf("Expected RCode NXDOMAIN, got %v", re.RCode)
+		}
+		if !re.Authoritative {
+			t.Errorf("Authoritative not set")
+		}
+		return re
+	}
+
+	/* The second error comes from the cache, and modifying the first
+	shouldn't affect it. */
+	re := lookup()
+	re.Server = "modified"
+	re.Err = nil
+	if re == lookup() {
+		t.Errorf("Cache returned the same *ResolveError twice")
+	}
+}
+
+func TestResolveErrorQueryAll(t *testing.T) {
+	/* Servers which hang up without answering */
+	var servers []string
+	want := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if nil != err {
+			t.Fatalf("Unable to listen: %v", err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if nil != err {
+					return
+				}
+				c.Close()
+			}
+		}()
+		s := "tcp://" + l.Addr().String()
+		servers = append(servers, s)
+		want[s] = true
+	}
+	r, err := NewResolver(QueryAll, servers...)
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+
+	/* Every server failed, but we should still know one of them */
+	_, err = r.LookupA("example.com")
+	var re *ResolveError
+	if !errors.As(err, &re) {
+		t.Fatalf("Error %v (%T) isn't a *ResolveError", err, err)
+	}
+	if !want[re.Server] {
+		t.Errorf(
+			"Unexpected server %q, want one of %q",
+			re.Server,
+			servers,
+		)
+	}
+	if RCodeNone != re.RCode {
+		t.Errorf("Expected RCodeNone, got %v", re.RCode)
+	}
+	if nil == re.Err || re.Err != errors.Unwrap(err) {
+		t.Errorf(
+			"Unwrap returned %v, not %v",
+			errors.Unwrap(err),
+			re.Err,
+		)
+	}
+}
+
+func TestResolveErrorNextOnFail(t *testing.T) {
+	want := [4]byte{192, 0, 2, 24}
+	refuse := func(
+		net.Addr,
+		*dnsmessage.Message,
+	) (dnsmessage.RCode, []dnsmessage.Resource) {
+		return dnsmessage.RCodeRefused, nil
+	}
+	refuser := newUDPServer(t, refuse)
+	answerer := newUDPServer(t, func(
+		net.Addr,
+		*dnsmessage.Message,
+	) (dnsmessage.RCode, []dnsmessage.Resource) {
+		return dnsmessage.RCodeSuccess, []dnsmessage.Resource{
+			aRR("example.com.", want),
+		}
+	})
+
+	/* The second server should answer after the first refuses */
+	r, err := NewResolver(NextOnFail, refuser, answerer)
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+	as, err := r.LookupA("example.com")
+	if nil != err {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if 1 != len(as) || want != as[0] {
+		t.Fatalf("Unexpected answer %v", as)
+	}
+
+	/* If every server fails, we should hear about the last one */
+	last := newUDPServer(t, refuse)
+	r, err = NewResolver(NextOnFail, refuser, last)
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+	_, err = r.LookupA("example.com")
+	var re *ResolveError
+	if !errors.As(err, &re) {
+		t.Fatalf("Error %v (%T) isn't a *ResolveError", err, err)
+	}
+	if !errors.Is(err, ErrRCRefused) {
+		t.Errorf("Expected REFUSED, got %v", err)
+	}
+	if last != re.Server {
+		t.Errorf("Expected server %q, got %q", last, re.Server)
+	}
+	if dnsmessage.RCodeRefused != re.RCode {
+		t.Errorf("Expected RCode REFUSED, got %v", re.RCode)
+	}
+}
+
+func TestResolveErrorError(t *testing.T) {
+	for _, c := range []struct {
+		re   ResolveError
+		want string
+	}{{
+		re:   ResolveError{Err: ErrAnswerTimeout},
+		want: "timeout waiting for answer",
+	}, {
+		re: ResolveError{
+			Server: "udp://192.0.2.1:53",
+			Err:    ErrRCServFail,
+		},
+		want: "udp://192.0.2.1:53: servfail",
+	}, {
+		re: ResolveError{
+			Server:        "tcp://192.0.2.1:53",
+			Authoritative: true,
+			Err:           ErrRCNXDomain,
+		},
+		want: "tcp://192.0.2.1:53: nxdomain (authoritative)",
+	}} {
+		if got := c.re.Error(); c.want != got {
+			t.Errorf("Got %q, want %q", got, c.want)
+		}
+	}
+}
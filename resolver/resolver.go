@@ -9,7 +9,7 @@ package resolver
  * Lightweight DNS resolver
  * By J. Stuart McMurray
  * Created 20180925
- * Last Modified 20181013
+ * Last Modified 20261017
  */
 
 import (
@@ -19,9 +19,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // QueryMethod is used to configure which server(s) are queried by resolver
@@ -49,8 +53,12 @@ const (
 	RETRYINTERVAL = 3 * time.Second
 )
 
-/* defport is the default DNS port */
-const defport = "53"
+/* defport is the default DNS port, and deftlsport is the default DNS over TLS
+port */
+const (
+	defport    = "53"
+	deftlsport = "853"
+)
 
 // StdlibResolver is a Resolver which wraps the net.Lookup* functions.  The
 // Resolver's LookupAC and LookupAAAAC methods will always return errors and
@@ -83,6 +91,9 @@ type serverAddr struct {
 	addr string
 }
 
+/* String returns the server in the form network://address. */
+func (s serverAddr) String() string { return s.net + "://" + s.addr }
+
 // Resolver implements a lightweight DNS resolver.
 type Resolver interface {
 	// LookupA returns the A records (IPv4 addresses) for the given name.
@@ -127,6 +138,119 @@ type Resolver interface {
 	// net.PacketConn) connection.  If this is set to a duration larger
 	// than QueryTimeout, queries will not be resent.
 	RetryInterval(rint time.Duration)
+
+	// LocalAddr sets the local IP address from which queries are sent,
+	// which is useful on multi-homed hosts.  The local port is chosen by
+	// the system.  A nil addr causes the system to choose the local
+	// address.  The address must be of the same family as the servers'
+	// addresses; queries to an IPv4 server from an IPv6 address (or vice
+	// versa) fail with a "no suitable address found" error.  LocalAddr
+	// only affects connections to servers made after it is called, and
+	// doesn't affect DNS over HTTPS queries made with a client set with
+	// HTTPClient.
+	LocalAddr(addr net.IP)
+
+	// DialControl sets a function which is called after creating the
+	// socket used to connect to a server but before connecting it, as
+	// with net.Dialer's Control field.  This can be used to set socket
+	// options (e.g. SO_BINDTODEVICE) to force queries out a specific
+	// interface.  DialControl only affects connections to servers made
+	// after it is called, and doesn't affect DNS over HTTPS queries made
+	// with a client set with HTTPClient.
+	DialControl(f func(network, address string, c syscall.RawConn) error)
+
+	// UnicodeNames sets whether internationalized names returned in
+	// records (e.g. by LookupCNAME or LookupMX) are converted from their
+	// ASCII (punycode) form to Unicode.  By default they are not.
+	// Non-ASCII names passed to the Lookup* methods are always converted
+	// to punycode before querying.  StdlibResolver ignores UnicodeNames
+	// and returns names as the net package does.
+	UnicodeNames(on bool)
+
+	// FollowCNAMEs sets the maximum number of CNAME records which will be
+	// followed when looking up records other than CNAMEs.  If the answer
+	// to a query contains a CNAME chain but no records for the end of the
+	// chain, the end of the chain will be queried as well.  Loops are
+	// detected and cause ErrCNAMELoop to be returned, and chains longer
+	// than depth cause ErrCNAMEChainTooLong to be returned.  A depth of 0,
+	// the default, causes only records for the queried name to be
+	// returned.
+	FollowCNAMEs(depth int)
+
+	// CacheNXDomain enables caching of NXDOMAIN replies, per RFC 2308.
+	// Names for which an NXDOMAIN reply with an SOA record in the
+	// authority section is received will not be queried again until the
+	// lesser of the SOA record's TTL, its MINIMUM field, and max has
+	// elapsed.  Instead, ErrRCNXDomain will be returned.  A max of 0, the
+	// default, disables caching and empties the cache.
+	CacheNXDomain(max time.Duration)
+
+	// ClientSubnet sets the subnet sent to servers in the EDNS Client
+	// Subnet option (RFC 7871) with every query.  A nil subnet, the
+	// default, causes no option to be sent.  A subnet with a zero-length
+	// mask (e.g. 0.0.0.0/0) causes an option to be sent which asks that
+	// servers not send the client's subnet upstream.  The subnet applies
+	// to every query made by the resolver; use a separate Resolver for
+	// each subnet to send different subnets for different lookups.  An
+	// error is returned if subnet isn't a valid IPv4 or IPv6 subnet.
+	ClientSubnet(subnet *net.IPNet) error
+
+	// TCPFallback enables falling back to TCP for queries to servers
+	// given as udp://, udp4://, or udp6://.  Queries which time out or
+	// otherwise fail, as well as queries which receive truncated replies,
+	// are retried via TCP to the same address.  After after consecutive
+	// failed UDP queries to a server, further queries to that server are
+	// sent only via TCP until a TCP query fails.  An after of 0, the
+	// default, disables falling back to TCP.
+	TCPFallback(after int)
+
+	// UDPSockets sets the number of sockets used to send queries to each
+	// server given as udp://, udp4://, or udp6://.  Each socket has its
+	// own source port, and queries to a server are sent from each of its
+	// sockets in turn, which spreads queries across source ports.  If n is
+	// lowered, queries in flight on sockets no longer used may fail.  The
+	// default is to use one socket per server.
+	UDPSockets(n int)
+
+	// CircuitBreaker causes queries to stop being sent for a while after
+	// too many fail.  The breaker tracks the results of the last window
+	// queries; when one fails and the fraction of them which failed is at
+	// least rate (between 0 and 1), lookups return ErrCircuitOpen without
+	// querying for between cooldown and one and a half times cooldown,
+	// chosen randomly.  The rate isn't checked until window queries have
+	// been made, so a few early failures don't open the breaker.  After
+	// the cool-down, a single query is sent as a probe while other lookups
+	// continue to return ErrCircuitOpen; if the probe succeeds queries are
+	// sent again with an empty window, and if it fails another cool-down
+	// starts.  NXDOMAIN replies are not failures.  If notify is not nil,
+	// it is called with true and the error which caused the breaker to
+	// open when queries stop and with false and nil when they succeed
+	// again.  It is called synchronously and should not block.  A window
+	// or rate of 0, the default, disables the circuit breaker.
+	CircuitBreaker(
+		rate float64,
+		window int,
+		cooldown time.Duration,
+		notify func(open bool, err error),
+	)
+
+	// HTTPClient sets the HTTP client used to make queries to servers
+	// given as https:// URLs.  A nil client, the default, causes a client
+	// like http.DefaultClient to be used, which uses the proxy given in
+	// the HTTPS_PROXY environment variable, if set, and which honors the
+	// settings from LocalAddr and DialControl.  Other clients do not.  To
+	// use a specific proxy, including one which requires authentication,
+	// use a client whose Transport's Proxy is set, e.g. with
+	// http.ProxyURL and a URL with a username and password.  Queries are
+	// sent through the proxy with HTTP CONNECT.
+	HTTPClient(c *http.Client)
+
+	// TLSConfig sets the TLS configuration used when connecting to servers
+	// given as tls:// URLs.  If conf's ServerName is empty, the host part
+	// of the server's address is used.  A nil conf, the default, causes
+	// the default configuration to be used.  TLSConfig only affects
+	// connections to servers made after it is called.
+	TLSConfig(conf *tls.Config)
 }
 
 /* buflen is the size of the buffers kept in the resolver's pool */
@@ -136,11 +260,18 @@ const buflen = 65536
 type resolver struct {
 	/* Connections to use */
 	servers []serverAddr
-	conns   []*conn
+	conns   [][]*conn /* Per-server sockets */
+	connsJ  []int     /* Next socket to use, per server */
 	connsI  int
 	connsL  *sync.Mutex
 	connsLs []*sync.Mutex /* Per-conn lock */
 
+	/* TCP conns to UDP servers and the number of consecutive failed
+	queries to each UDP server, used for falling back to TCP.  These are
+	also protected by connsLs. */
+	tcpConns []*conn
+	udpFails []int
+
 	/* Used if we have multiple servers to query */
 	nextServer  int
 	queryMethod QueryMethod
@@ -153,14 +284,69 @@ type resolver struct {
 	qto  time.Duration
 	rint time.Duration
 	qtoL sync.RWMutex /* We'll use this for both. */
+
+	/* Source of time for the above */
+	clock clock
+
+	/* Connects to servers, normally r.dialServer */
+	dial func(s serverAddr) (net.Conn, error)
+
+	/* Local address, socket control function, and TLS config used when
+	dialing */
+	laddr   net.IP
+	dialCtl func(network, address string, c syscall.RawConn) error
+	tlsConf *tls.Config
+	dialL   sync.RWMutex
+
+	/* Whether to convert returned names to Unicode, how far to follow
+	CNAME chains, the EDNS Client Subnet option to send, when to fall
+	back to TCP, how many sockets to use per UDP server, and the HTTP
+	client to use for DoH */
+	unicode    bool
+	cnameDepth int
+	ecs        *dnsmessage.Option
+	tcpAfter   int
+	nSocks     int
+	httpClient *http.Client
+	optL       sync.RWMutex
+
+	/* HTTP client used for DoH if httpClient is nil */
+	dohClient *http.Client
+	dohOnce   sync.Once
+
+	/* Cache of names which don't exist and when they expire */
+	negCache    map[string]negCacheEntry
+	negCacheMax time.Duration
+	negCacheL   sync.Mutex
+
+	/* Circuit breaker state */
+	cbRate    float64                    /* Failure rate to open */
+	cbWindow  []bool                     /* Recent failures, a ring */
+	cbNext    int                        /* Next index in cbWindow */
+	cbSeen    int                        /* Results in cbWindow */
+	cbFails   int                        /* Failures in cbWindow */
+	cbCool    time.Duration              /* Cool-down time */
+	cbNotify  func(open bool, err error) /* Called on state change */
+	cbOpen    bool                       /* Queries stopped */
+	cbProbing bool                       /* Half-open probe in flight */
+	cbUntil   time.Time                  /* End of cool-down */
+	cbL       sync.Mutex
 }
 
 // NewResolver returns a resolver which makes queries to the given servers.
 // How the servers are queried is determined by method.  The servers should be
 // given as URLs of the form network://address[:port].  Any network accepted by
 // net.Dial is accepted, as is "tls", which will cause the DNS queries to be
-// made over a TLS connection.  If a port is omitted on addresses which would
-// normally require it (e.g. tcp), port 53 will be used.
+// made over a TLS connection (RFC 7858).  If a port is omitted on addresses
+// which would normally require it (e.g. tcp), port 53 will be used, or port
+// 853 for tls.  Note that tls:// servers without a port used port 53 in older
+// versions of this package.  The TLS configuration may be set with the
+// returned Resolver's TLSConfig method.  Servers may also be given as https://
+// URLs, which will cause queries to be made using DNS over HTTPS (RFC 8484)
+// POST requests, or GET requests if the URL has a dns query parameter, e.g.
+// https://example.com/dns-query?dns.  If no path is given in an https:// URL,
+// /dns-query will be used.  Errors returned by the returned Resolver's Lookup*
+// methods are of type *ResolveError.
 func NewResolver(method QueryMethod, servers ...string) (Resolver, error) {
 	/* Make sure we actually have servers */
 	if 0 == len(servers) {
@@ -194,19 +380,42 @@ func NewResolver(method QueryMethod, servers ...string) (Resolver, error) {
 				err.Error(),
 				"missing port in address",
 			) { /* Missing port */
-				parts[1] = net.JoinHostPort(parts[1], defport)
+				p := defport
+				if "tls" == parts[0] {
+					p = deftlsport
+				}
+				/* JoinHostPort adds its own brackets */
+				h := parts[1]
+				if strings.HasPrefix(h, "[") &&
+					strings.HasSuffix(h, "]") {
+					h = h[1 : len(h)-1]
+				}
+				parts[1] = net.JoinHostPort(h, p)
 			} else if "" == h { /* No address */
 				return nil, fmt.Errorf(
 					"missing address in %q",
 					server,
 				)
 			}
+		case "https":
+			a, err := dohAddr(parts[1])
+			if nil != err {
+				return nil, fmt.Errorf(
+					"invalid server %q: %w",
+					server,
+					err,
+				)
+			}
+			parts[1] = a
 		}
 
 		res.servers[i] = serverAddr{parts[0], parts[1]}
 	}
 	/* Add space for the conns and locks */
-	res.conns = make([]*conn, len(servers))
+	res.conns = make([][]*conn, len(servers))
+	res.connsJ = make([]int, len(servers))
+	res.tcpConns = make([]*conn, len(servers))
+	res.udpFails = make([]int, len(servers))
 	res.connsLs = make([]*sync.Mutex, len(servers))
 	for i := range res.connsLs {
 		res.connsLs[i] = new(sync.Mutex)
@@ -224,7 +433,13 @@ func NewResolver(method QueryMethod, servers ...string) (Resolver, error) {
 // channel must be serviced or resolution will hang.
 func NewResolverFromConn(c net.Conn) Resolver {
 	res := newResolver()
-	res.conns = append(res.conns, res.newConn(c))
+	/* Name the server for errors, if we can */
+	var server string
+	if ra := c.RemoteAddr(); nil != ra {
+		server = ra.String()
+	}
+
+	res.conns = append(res.conns, []*conn{res.newConn(c, server)})
 	res.queryMethod = RoundRobin
 
 	return res
@@ -233,19 +448,24 @@ func NewResolverFromConn(c net.Conn) Resolver {
 /* newResolver makes and initializes as much of a resolver as can be
 initialized without a conn or query method */
 func newResolver() *resolver {
-	return &resolver{
+	r := &resolver{
 		connsL:  new(sync.Mutex),
 		bufpool: newBufPool(buflen),
 		upool:   newBufPool(2),
 		qto:     TIMEOUT,
 		rint:    RETRYINTERVAL,
+		clock:   realClock{},
 	}
+	r.dial = r.dialServer
+	return r
 }
 
-/* newConn makes a new conn for the resolver */
-func (r *resolver) newConn(c net.Conn) *conn {
+/* newConn makes a new conn for the resolver.  The server is used to identify
+the server in errors. */
+func (r *resolver) newConn(c net.Conn, server string) *conn {
 	ret := &conn{
 		r:      r,
+		server: server,
 		c:      c,
 		txL:    new(sync.Mutex),
 		ansCh:  make(map[uint16]chan<- ansOrErr),
@@ -273,6 +493,44 @@ func (r *resolver) RetryInterval(rint time.Duration) {
 	r.rint = rint
 }
 
+// UDPSockets sets the number of sockets to use per UDP server.
+func (r *resolver) UDPSockets(n int) {
+	r.optL.Lock()
+	defer r.optL.Unlock()
+	r.nSocks = n
+}
+
+// FollowCNAMEs sets the maximum length of CNAME chains to follow.
+func (r *resolver) FollowCNAMEs(depth int) {
+	r.optL.Lock()
+	defer r.optL.Unlock()
+	r.cnameDepth = depth
+}
+
+// LocalAddr sets the local address used when connecting to servers.
+func (r *resolver) LocalAddr(addr net.IP) {
+	r.dialL.Lock()
+	defer r.dialL.Unlock()
+	r.laddr = addr
+}
+
+// TLSConfig sets the TLS configuration used for tls:// servers.
+func (r *resolver) TLSConfig(conf *tls.Config) {
+	r.dialL.Lock()
+	defer r.dialL.Unlock()
+	r.tlsConf = conf
+}
+
+// DialControl sets the function called on sockets before connecting to
+// servers.
+func (r *resolver) DialControl(
+	f func(network, address string, c syscall.RawConn) error,
+) {
+	r.dialL.Lock()
+	defer r.dialL.Unlock()
+	r.dialCtl = f
+}
+
 /* newBufPool returns a new sync.Pool which holds buffers of the given size. */
 func newBufPool(size uint) *sync.Pool {
 	return &sync.Pool{New: func() interface{} {
@@ -290,59 +548,105 @@ func (r *resolver) randUint16() (uint16, error) {
 	return binary.LittleEndian.Uint16(b), nil
 }
 
-/* nextRRConn returns the next conn from r, round-robin. */
-func (r *resolver) nextRRConn() (*conn, error) {
-	/* Work out which conn to use */
+/* nextRRIndex returns the index of the next server to use, round-robin. */
+func (r *resolver) nextRRIndex() int {
 	r.connsL.Lock()
+	defer r.connsL.Unlock()
 	i := r.connsI
 	r.connsI++
 	r.connsI %= len(r.servers)
-	r.connsL.Unlock()
-
-	/* Make sure it exists and use it */
-	return r.getOrDialConn(i)
-
+	return i
 }
 
-/* getOrDialConn gets the ith conn, or dial it if needed */
+/* getOrDialConn gets a conn to the ith server, or dials one if needed.  If
+the server is a UDP server and r is configured to use more than one socket per
+server, the sockets are used in turn. */
 func (r *resolver) getOrDialConn(i int) (*conn, error) {
-	/* Grab hold of the conn */
+	/* Work out how many sockets we should have */
+	n := 1
+	if _, ok := tcpNet(r.servers[i].net); ok {
+		r.optL.RLock()
+		if 1 < r.nSocks {
+			n = r.nSocks
+		}
+		r.optL.RUnlock()
+	}
+
+	/* Grab hold of the conns */
 	r.connsLs[i].Lock()
 	defer r.connsLs[i].Unlock()
 
-	/* Dial timeout */
-	r.qtoL.Lock()
-	to := r.qto
-	r.qtoL.Unlock()
-
-	/* If it's not connected or there's been an error, redial */
-	if nil == r.conns[i] || nil != r.conns[i].getErr() {
-		/* Connect to the server */
-		var (
-			c   net.Conn
-			err error
-		)
-		switch r.servers[i].net {
-		case "tls":
-			c, err = tls.DialWithDialer(
-				&net.Dialer{Timeout: to},
-				"tcp",
-				r.servers[i].addr,
-				nil,
-			)
-		default:
-			c, err = net.DialTimeout(
-				r.servers[i].net,
-				r.servers[i].addr,
-				to,
-			)
-		}
-		if nil != err {
-			return nil, err
+	/* Add or remove sockets if the number's changed */
+	for n < len(r.conns[i]) {
+		last := len(r.conns[i]) - 1
+		if c := r.conns[i][last]; nil != c {
+			c.c.Close()
 		}
-		/* Store it for future use */
-		r.conns[i] = r.newConn(c)
+		r.conns[i] = r.conns[i][:last]
+	}
+	for n > len(r.conns[i]) {
+		r.conns[i] = append(r.conns[i], nil)
+	}
+
+	/* Use the next one */
+	j := r.connsJ[i] % n
+	r.connsJ[i] = (j + 1) % n
+	return r.dialIfNeeded(&r.conns[i][j], r.servers[i])
+}
+
+/* dialIfNeeded dials s and stores the new conn in *cp if *cp is nil or has
+had an error, and returns *cp.  The caller must hold the lock for *cp. */
+func (r *resolver) dialIfNeeded(cp **conn, s serverAddr) (*conn, error) {
+	/* If it's connected and there's been no error, use it */
+	if nil != *cp && nil == (*cp).getErr() {
+		return *cp, nil
+	}
+
+	/* Connect to the server */
+	c, err := r.dial(s)
+	if nil != err {
+		return nil, newResolveError(s.String(), nil, err)
+	}
+
+	/* Store it for future use */
+	*cp = r.newConn(c, s.String())
+	return *cp, nil
+}
+
+/* dialServer connects to the server s. */
+func (r *resolver) dialServer(s serverAddr) (net.Conn, error) {
+	d := r.dialer(s.net)
+	if "tls" != s.net {
+		return d.Dial(s.net, s.addr)
+	}
+	r.dialL.RLock()
+	tc := r.tlsConf
+	r.dialL.RUnlock()
+	return tls.DialWithDialer(d, "tcp", s.addr, tc)
+}
+
+/* dialer returns a net.Dialer suitable for connecting to a server using the
+given network. */
+func (r *resolver) dialer(network string) *net.Dialer {
+	/* Dial timeout */
+	r.qtoL.RLock()
+	d := &net.Dialer{Timeout: r.qto}
+	r.qtoL.RUnlock()
+
+	r.dialL.RLock()
+	defer r.dialL.RUnlock()
+	d.Control = r.dialCtl
+
+	/* The local address has to be the right type for the network */
+	if nil == r.laddr {
+		return d
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+		d.LocalAddr = &net.UDPAddr{IP: r.laddr}
+	case "tcp", "tcp4", "tcp6", "tls":
+		d.LocalAddr = &net.TCPAddr{IP: r.laddr}
 	}
 
-	return r.conns[i], nil
+	return d
 }
@@ -0,0 +1,92 @@
+package resolver
+
+/*
+ * resolver_test.go
+ * Make sure the resolver manages its conns
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNewResolverPorts(t *testing.T) {
+	for _, c := range []struct {
+		server string
+		want   string
+	}{
+		{"udp://192.0.2.1", "192.0.2.1:53"},
+		{"tcp://192.0.2.1", "192.0.2.1:53"},
+		{"tls://192.0.2.1", "192.0.2.1:853"},
+		{"udp://192.0.2.1:5353", "192.0.2.1:5353"},
+		{"tls://192.0.2.1:53", "192.0.2.1:53"},
+		{"udp://[2001:db8::1]", "[2001:db8::1]:53"},
+		{"tls://[2001:db8::1]", "[2001:db8::1]:853"},
+		{"tls://[2001:db8::1]:8853", "[2001:db8::1]:8853"},
+		{"tls://dns.example.com", "dns.example.com:853"},
+	} {
+		r, err := NewResolver(RoundRobin, c.server)
+		if nil != err {
+			t.Errorf("NewResolver(%q): %v", c.server, err)
+			continue
+		}
+		if got := r.(*resolver).servers[0].addr; c.want != got {
+			t.Errorf(
+				"NewResolver(%q): got address %q, want %q",
+				c.server,
+				got,
+				c.want,
+			)
+		}
+	}
+}
+
+func TestUDPSockets(t *testing.T) {
+	r, _, qch, cch := newDialResolver(t)
+	want := [4]byte{192, 0, 2, 9}
+
+	/* socks does n lookups and returns the sockets used for each */
+	socks := func(n int) []int {
+		t.Helper()
+		var ss []int
+		for i := 0; i < n; i++ {
+			res := goLookupA(r, "example.com")
+			q := nextQuery(t, qch, false)
+			ss = append(ss, q.sock)
+			answerA(t, q, want, res)
+		}
+		return ss
+	}
+
+	/* Each socket should be used in turn */
+	r.UDPSockets(3)
+	if got, want := socks(6), []int{0, 1, 2, 0, 1, 2}; !reflect.DeepEqual(
+		want,
+		got,
+	) {
+		t.Fatalf("Expected sockets %v, got %v", want, got)
+	}
+
+	/* Fewer sockets should close the extras */
+	r.UDPSockets(1)
+	if got, want := socks(2), []int{0, 0}; !reflect.DeepEqual(
+		want,
+		got,
+	) {
+		t.Fatalf("Expected sockets %v, got %v", want, got)
+	}
+	closed := []int{<-cch, <-cch}
+	sort.Ints(closed)
+	if want := []int{1, 2}; !reflect.DeepEqual(want, closed) {
+		t.Fatalf("Expected sockets %v closed, got %v", want, closed)
+	}
+	select {
+	case s := <-cch:
+		t.Fatalf("Socket %v unexpectedly closed", s)
+	default:
+	}
+}
@@ -0,0 +1,118 @@
+package resolver
+
+/*
+ * tcpfallback.go
+ * Fall back to TCP when UDP isn't working
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261016
+ */
+
+import "golang.org/x/net/dns/dnsmessage"
+
+// TCPFallback sets when queries to UDP servers fall back to TCP.
+func (r *resolver) TCPFallback(after int) {
+	r.optL.Lock()
+	defer r.optL.Unlock()
+	r.tcpAfter = after
+}
+
+/* queryServer sends qm to the ith server, falling back to TCP if r is so
+configured.  The server actually queried is returned with the reply. */
+func (r *resolver) queryServer(i int, qm *dnsmessage.Message) (
+	*dnsmessage.Message,
+	string,
+	error,
+) {
+	/* DoH servers don't have conns */
+	if "https" == r.servers[i].net {
+		am, err := r.queryDoH(r.servers[i], qm)
+		return am, r.servers[i].String(), err
+	}
+
+	r.optL.RLock()
+	after := r.tcpAfter
+	r.optL.RUnlock()
+
+	/* If we're not falling back, life's easy */
+	tnet, ok := tcpNet(r.servers[i].net)
+	if 0 >= after || !ok {
+		c, err := r.getOrDialConn(i)
+		if nil != err {
+			return nil, r.servers[i].String(), err
+		}
+		am, err := c.query(qm)
+		return am, c.server, err
+	}
+
+	/* Try UDP first, unless it's been failing */
+	if !r.udpFailing(i, after) {
+		c, err := r.getOrDialConn(i)
+		if nil == err {
+			var am *dnsmessage.Message
+			am, err = c.query(qm)
+			r.noteUDP(i, nil == err)
+			if nil == err && !am.Header.Truncated {
+				return am, c.server, nil
+			}
+		}
+	}
+
+	/* Try again with TCP */
+	ts := serverAddr{net: tnet, addr: r.servers[i].addr}
+	c, err := r.getOrDialTCPConn(i, ts)
+	if nil != err {
+		r.resetUDP(i)
+		return nil, ts.String(), err
+	}
+	am, err := c.query(qm)
+	if nil != err {
+		r.resetUDP(i)
+	}
+	return am, c.server, err
+}
+
+/* getOrDialTCPConn gets the TCP conn to the ith server, which should be ts,
+or dials it if needed. */
+func (r *resolver) getOrDialTCPConn(i int, ts serverAddr) (*conn, error) {
+	r.connsLs[i].Lock()
+	defer r.connsLs[i].Unlock()
+	return r.dialIfNeeded(&r.tcpConns[i], ts)
+}
+
+/* udpFailing returns true if at least after queries to the ith server have
+failed in a row. */
+func (r *resolver) udpFailing(i, after int) bool {
+	r.connsLs[i].Lock()
+	defer r.connsLs[i].Unlock()
+	return after <= r.udpFails[i]
+}
+
+/* noteUDP notes whether a UDP query to the ith server worked */
+func (r *resolver) noteUDP(i int, worked bool) {
+	r.connsLs[i].Lock()
+	defer r.connsLs[i].Unlock()
+	if worked {
+		r.udpFails[i] = 0
+	} else {
+		r.udpFails[i]++
+	}
+}
+
+/* resetUDP causes UDP to be tried again for the ith server. */
+func (r *resolver) resetUDP(i int) { r.noteUDP(i, true) }
+
+/* tcpNet returns the TCP network corresponding to the UDP network n.  If n
+isn't a UDP network, tcpNet returns false. */
+func tcpNet(n string) (string, bool) {
+	switch n {
+	case "udp":
+		return "tcp", true
+	case "udp4":
+		return "tcp4", true
+	case "udp6":
+		return "tcp6", true
+	default:
+		return "", false
+	}
+}
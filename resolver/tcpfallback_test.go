@@ -0,0 +1,132 @@
+package resolver
+
+/*
+ * tcpfallback_test.go
+ * Make sure we fall back to TCP, in virtual time
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* nextQuery gets the next query from qch and makes sure it came in over TCP
+if stream is true or UDP if not. */
+func nextQuery(t *testing.T, qch <-chan testQuery, stream bool) testQuery {
+	t.Helper()
+	q := <-qch
+	if stream != q.stream() {
+		t.Fatalf("Query sent via wrong protocol (stream:%v)", !stream)
+	}
+	return q
+}
+
+/* answerA answers q with a and makes sure res gets it. */
+func answerA(t *testing.T, q testQuery, a [4]byte, res <-chan aResult) {
+	t.Helper()
+	if !reply(
+		t,
+		q.c,
+		q.qm,
+		dnsmessage.RCodeSuccess,
+		[]dnsmessage.Resource{aRR(q.qm.Questions[0].Name.String(), a)},
+		nil,
+		q.flags,
+	) {
+		t.FailNow()
+	}
+	got := <-res
+	if nil != got.err {
+		t.Fatalf("Lookup failed: %v", got.err)
+	}
+	if 1 != len(got.as) || a != got.as[0] {
+		t.Fatalf("Unexpected answer %v", got.as)
+	}
+}
+
+/* timeOutUDP waits for a UDP query and lets it time out, and returns the TCP
+query sent in its place. */
+func timeOutUDP(
+	t *testing.T,
+	fc *fakeClock,
+	qch <-chan testQuery,
+) testQuery {
+	t.Helper()
+	nextQuery(t, qch, false)
+	fc.waitForAt(fc.now().Add(TIMEOUT))
+	fc.advance(TIMEOUT)
+	q := nextQuery(t, qch, true)
+	/* Keep the next query's timeout from lining up with this one's */
+	fc.advance(time.Second)
+	return q
+}
+
+/* newFallbackResolver returns a resolver from newDialResolver which falls
+back to TCP after the given number of failures and doesn't resend queries. */
+func newFallbackResolver(t *testing.T, after int) (
+	*resolver,
+	*fakeClock,
+	<-chan testQuery,
+) {
+	r, fc, qch, _ := newDialResolver(t)
+	r.TCPFallback(after)
+	r.RetryInterval(2 * TIMEOUT)
+	return r, fc, qch
+}
+
+func TestTCPFallbackTruncated(t *testing.T) {
+	r, _, qch := newFallbackResolver(t, 3)
+	want := [4]byte{192, 0, 2, 6}
+
+	/* A truncated reply should get a retry via TCP */
+	res := goLookupA(r, "example.com")
+	q := nextQuery(t, qch, false)
+	if !reply(t, q.c, q.qm, dnsmessage.RCodeSuccess, nil, nil, replyTC) {
+		t.FailNow()
+	}
+	answerA(t, nextQuery(t, qch, true), want, res)
+
+	/* Truncation isn't failure, so the next query should be UDP */
+	res = goLookupA(r, "example.com")
+	answerA(t, nextQuery(t, qch, false), want, res)
+}
+
+func TestTCPFallbackTCPOnly(t *testing.T) {
+	r, fc, qch := newFallbackResolver(t, 2)
+	want := [4]byte{192, 0, 2, 7}
+
+	/* Two timeouts via UDP should each fall back to TCP */
+	for i := 0; i < 2; i++ {
+		res := goLookupA(r, "example.com")
+		answerA(t, timeOutUDP(t, fc, qch), want, res)
+	}
+
+	/* After which we should only use TCP */
+	for i := 0; i < 2; i++ {
+		res := goLookupA(r, "example.com")
+		answerA(t, nextQuery(t, qch, true), want, res)
+	}
+}
+
+func TestTCPFallbackBackToUDP(t *testing.T) {
+	r, fc, qch := newFallbackResolver(t, 1)
+	want := [4]byte{192, 0, 2, 8}
+
+	/* One timeout gets us to TCP only */
+	res := goLookupA(r, "example.com")
+	answerA(t, timeOutUDP(t, fc, qch), want, res)
+
+	/* A TCP failure should send us back to UDP */
+	res = goLookupA(r, "example.com")
+	nextQuery(t, qch, true).c.Close()
+	if got := <-res; nil == got.err {
+		t.Fatalf("Lookup succeeded after TCP hangup: %v", got.as)
+	}
+	res = goLookupA(r, "example.com")
+	answerA(t, nextQuery(t, qch, false), want, res)
+}
@@ -0,0 +1,68 @@
+package resolver
+
+/*
+ * tls_test.go
+ * Make sure DNS over TLS works
+ * By J. Stuart McMurray
+ * Created 20261016
+ * Last Modified 20261017
+ */
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDoT(t *testing.T) {
+	want := [4]byte{192, 0, 2, 85}
+
+	/* Steal a certificate and a config which trusts it */
+	hs := httptest.NewTLSServer(http.NotFoundHandler())
+	defer hs.Close()
+	conf := hs.Client().Transport.(*http.Transport).TLSClientConfig
+
+	/* Listen for TLS connections with the stolen certificate */
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: hs.TLS.Certificates,
+	})
+	if nil != err {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer l.Close()
+
+	/* Answer one query */
+	go func() {
+		c, err := l.Accept()
+		if nil != err {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		defer c.Close()
+		qm := readQuery(t, c, true)
+		if nil == qm {
+			t.Errorf("Did not get query")
+			return
+		}
+		reply(t, c, qm, dnsmessage.RCodeSuccess, []dnsmessage.Resource{
+			aRR(qm.Questions[0].Name.String(), want),
+		}, nil, replyStream)
+	}()
+
+	/* Query it */
+	r, err := NewResolver(RoundRobin, "tls://"+l.Addr().String())
+	if nil != err {
+		t.Fatalf("Unable to make resolver: %v", err)
+	}
+	r.TLSConfig(conf)
+	as, err := r.LookupA("example.com")
+	if nil != err {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if 1 != len(as) || want != as[0] {
+		t.Fatalf("Unexpected answer %v", as)
+	}
+}